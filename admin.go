@@ -0,0 +1,321 @@
+/* go-websockproxy - https://github.com/gdm85/go-websockproxy
+Copyright (C) 2016 gdm85
+
+This program is free software; you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation; either version 2 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License along
+with this program; if not, write to the Free Software Foundation, Inc.,
+51 Franklin Street, Fifth Floor, Boston, MA 02110-1301 USA.
+*/
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// newAdminHandler returns the handler of the administrative interface, which should be reachable only by the operators.
+func newAdminHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/reload", adminReload)
+	mux.HandleFunc("/stats", adminStats)
+	mux.HandleFunc("/metrics", serveMetrics)
+	mux.HandleFunc("/bans", adminBans)
+	mux.HandleFunc("/bans/add", adminAddBan)
+	mux.HandleFunc("/bans/lift", adminLiftBan)
+	mux.HandleFunc("/limits", adminLimits)
+	mux.HandleFunc("/limits/set", adminSetLimits)
+	mux.HandleFunc("/limits/reset", adminResetLimits)
+	mux.HandleFunc("/impairments", adminImpairments)
+	mux.HandleFunc("/impairments/set", adminSetImpairment)
+	mux.HandleFunc("/impairments/clear", adminClearImpairment)
+	return mux
+}
+
+// adminLimits responds with the bandwidth limits of each client; overridden limits are marked as such.
+func adminLimits(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	for _, c := range hub.List() {
+		var overridden string
+		if c.RatesOverridden() {
+			overridden = " (overridden)"
+		}
+		fmt.Fprintf(w, "client %d identity=%q upload=%v download=%v%s\n", c.id, c.Policy().Identity, c.upload.Bandwidth(), c.download.Bandwidth(), overridden)
+	}
+}
+
+// limitTargets parses the 'client' or the 'identity' parameter, which specify the clients whose limits are changed;
+// it responds with an error and returns false if there are no such clients.
+func limitTargets(w http.ResponseWriter, r *http.Request) ([]*Client, bool) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return nil, false
+	}
+	id, identity := r.FormValue("client"), r.FormValue("identity")
+	if (id == "") == (identity == "") {
+		http.Error(w, "either client or identity must be specified", http.StatusBadRequest)
+		return nil, false
+	}
+	if identity != "" {
+		clients := hub.Sessions(identity)
+		if len(clients) == 0 {
+			http.Error(w, "no clients of such identity", http.StatusNotFound)
+			return nil, false
+		}
+		return clients, true
+	}
+	n, err := strconv.ParseUint(id, 10, 64)
+	if err != nil {
+		http.Error(w, "invalid client", http.StatusBadRequest)
+		return nil, false
+	}
+	c := hub.Client(n)
+	if c == nil {
+		http.Error(w, "no such client", http.StatusNotFound)
+		return nil, false
+	}
+	return []*Client{c}, true
+}
+
+// adminSetLimits overrides the 'upload' and 'download' bandwidth limits of the client specified with the 'client'
+// parameter, or of all the clients of the identity specified with the 'identity' parameter; '0' removes the limit.
+func adminSetLimits(w http.ResponseWriter, r *http.Request) {
+	clients, ok := limitTargets(w, r)
+	if !ok {
+		return
+	}
+	var upload, download *Bandwidth
+	for _, p := range []struct {
+		name      string
+		bandwidth **Bandwidth
+	}{{"upload", &upload}, {"download", &download}} {
+		s := r.FormValue(p.name)
+		if s == "" {
+			continue
+		}
+		bw, err := parseBandwidth(s)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("invalid %s bandwidth: %v", p.name, err), http.StatusBadRequest)
+			return
+		}
+		*p.bandwidth = &bw
+	}
+	if upload == nil && download == nil {
+		http.Error(w, "either upload or download must be specified", http.StatusBadRequest)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	for _, c := range clients {
+		c.OverrideRates(upload, download)
+		fmt.Fprintf(w, "client %d upload=%v download=%v\n", c.id, c.upload.Bandwidth(), c.download.Bandwidth())
+	}
+}
+
+// adminResetLimits restores the bandwidth limits of the policy of the client or of the clients of the identity.
+func adminResetLimits(w http.ResponseWriter, r *http.Request) {
+	clients, ok := limitTargets(w, r)
+	if !ok {
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	for _, c := range clients {
+		if c.ResetRates() {
+			fmt.Fprintf(w, "client %d upload=%v download=%v\n", c.id, c.upload.Bandwidth(), c.download.Bandwidth())
+		}
+	}
+}
+
+// adminImpairments responds with the list of link impairments.
+func adminImpairments(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	for _, line := range impairments.List() {
+		fmt.Fprintln(w, line)
+	}
+}
+
+// impairmentTarget parses the 'client' or the 'network' parameter, which specify the target of an impairment;
+// it responds with an error and returns false if the target is invalid.
+func impairmentTarget(w http.ResponseWriter, r *http.Request) (client *Client, vlan int, ok bool) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return nil, 0, false
+	}
+	id, network := r.FormValue("client"), r.FormValue("network")
+	if (id == "") == (network == "") {
+		http.Error(w, "either client or network must be specified", http.StatusBadRequest)
+		return nil, 0, false
+	}
+	if network != "" {
+		v, err := strconv.Atoi(network)
+		if err != nil || v < 0 || v > 4094 {
+			http.Error(w, "invalid network", http.StatusBadRequest)
+			return nil, 0, false
+		}
+		return nil, v, true
+	}
+	n, err := strconv.ParseUint(id, 10, 64)
+	if err != nil {
+		http.Error(w, "invalid client", http.StatusBadRequest)
+		return nil, 0, false
+	}
+	client = hub.Client(n)
+	if client == nil {
+		http.Error(w, "no such client", http.StatusNotFound)
+		return nil, 0, false
+	}
+	return client, 0, true
+}
+
+// adminSetImpairment impairs the link of the client specified with the 'client' parameter, or the links of the network
+// specified with the 'network' parameter, replacing any previous impairment.
+func adminSetImpairment(w http.ResponseWriter, r *http.Request) {
+	client, vlan, ok := impairmentTarget(w, r)
+	if !ok {
+		return
+	}
+	imp, err := parseImpairment(r.Form)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if client != nil {
+		impairments.SetClient(client.id, imp)
+	} else {
+		impairments.SetNetwork(vlan, imp)
+	}
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	fmt.Fprintln(w, imp)
+}
+
+// adminClearImpairment removes the impairment of the client or of the network.
+func adminClearImpairment(w http.ResponseWriter, r *http.Request) {
+	client, vlan, ok := impairmentTarget(w, r)
+	if !ok {
+		return
+	}
+	if client != nil {
+		ok = impairments.ClearClient(client.id)
+	} else {
+		ok = impairments.ClearNetwork(vlan)
+	}
+	if !ok {
+		http.Error(w, "link is not impaired", http.StatusNotFound)
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	fmt.Fprintln(w, "impairment cleared")
+}
+
+// adminBans responds with the list of active bans.
+func adminBans(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	for _, b := range bans.List() {
+		until := "permanent"
+		if !b.Until.IsZero() {
+			until = b.Until.Format(time.RFC3339)
+		}
+		fmt.Fprintf(w, "%s %s %s\n", b.Address, until, b.Reason)
+	}
+}
+
+// adminAddBan bans the address specified with the 'address' parameter for the 'duration' parameter, permanently if
+// missing, and disconnects its clients.
+func adminAddBan(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	address := r.FormValue("address")
+	if address == "" {
+		http.Error(w, "missing address", http.StatusBadRequest)
+		return
+	}
+	host := address
+	if i := strings.IndexByte(host, '/'); i != -1 {
+		host = host[:i]
+	}
+	if net.ParseIP(host) == nil {
+		http.Error(w, "invalid address", http.StatusBadRequest)
+		return
+	}
+	var duration time.Duration
+	if s := r.FormValue("duration"); s != "" {
+		var err error
+		duration, err = time.ParseDuration(s)
+		if err != nil || duration <= 0 {
+			http.Error(w, "invalid duration", http.StatusBadRequest)
+			return
+		}
+	}
+	reason := r.FormValue("reason")
+	if reason == "" {
+		reason = "banned by administrator"
+	}
+
+	b := bans.Add(address, duration, reason)
+	n := hub.DisconnectAddress(address, closePolicyViolation, "banned")
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	if b.Until.IsZero() {
+		fmt.Fprintf(w, "%s banned permanently, %d clients disconnected\n", b.Address, n)
+	} else {
+		fmt.Fprintf(w, "%s banned until %s, %d clients disconnected\n", b.Address, b.Until.Format(time.RFC3339), n)
+	}
+}
+
+// adminLiftBan lifts the ban of the address specified with the 'address' parameter.
+func adminLiftBan(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	address := r.FormValue("address")
+	if address == "" {
+		http.Error(w, "missing address", http.StatusBadRequest)
+		return
+	}
+	if !bans.Lift(address) {
+		http.Error(w, "address is not banned", http.StatusNotFound)
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	fmt.Fprintln(w, "ban lifted")
+}
+
+// adminStats responds with the current value of all counters.
+func adminStats(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	stats.WriteTo(w)
+}
+
+// adminReload reloads the configuration and responds with the report of what changed.
+func adminReload(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	report, err := reloadConfig()
+	if err != nil {
+		logAdmin.Error("config_reload_failed", nil, "reloading configuration: %v", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	if len(report) == 0 {
+		fmt.Fprintln(w, "nothing changed")
+		return
+	}
+	fmt.Fprintln(w, strings.Join(report, "\n"))
+}
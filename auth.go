@@ -0,0 +1,133 @@
+/* go-websockproxy - https://github.com/gdm85/go-websockproxy
+Copyright (C) 2016 gdm85
+
+This program is free software; you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation; either version 2 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License along
+with this program; if not, write to the Free Software Foundation, Inc.,
+51 Franklin Street, Fifth Floor, Boston, MA 02110-1301 USA.
+*/
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+	"strings"
+)
+
+// Challenge-response authorization works with special frames: right after connecting the server sends "CHAL <nonce>"
+// and the client answers with "HMAC [<identity> ]<response>", where the response is the hex-encoded HMAC-SHA256 of the
+// nonce bytes keyed with the AUTH key. The identity is required for keys of the key file and omitted for the shared key.
+
+// specialFramePrefix starts every special frame: an invalid MAC address made of 0s
+const specialFramePrefix = "\x00\x00\x00\x00\x00\x00"
+
+// size in bytes of the challenge nonces
+const nonceSize = 32
+
+var errPlainAuthDisabled = errors.New("ignoring AUTH frame (plain authorization disabled, challenge-response is required)")
+
+// isSpecialFrame returns true if the frame is a special frame.
+func isSpecialFrame(frame []byte) bool {
+	return len(frame) >= len(specialFramePrefix) && string(frame[:len(specialFramePrefix)]) == specialFramePrefix
+}
+
+// newSpecialFrame returns a special frame with the specified payload.
+func newSpecialFrame(payload string) []byte {
+	return append([]byte(specialFramePrefix), payload...)
+}
+
+// sendSpecialFrame queues a special frame for the client; special frames are neither rate limited nor accounted in
+// the memory budget.
+func (c *Client) sendSpecialFrame(payload string) {
+	if !c.frames.Push(priorityControl, newSpecialFrame(payload)) {
+		logSwitch.Warning("special_frame_dropped", c, "could not queue special frame")
+	}
+}
+
+// sendChallenge generates a new nonce and sends the challenge to the client.
+func (c *Client) sendChallenge() error {
+	nonce := make([]byte, nonceSize)
+	if _, err := rand.Read(nonce); err != nil {
+		return err
+	}
+	c.mu.Lock()
+	c.nonce = nonce
+	c.mu.Unlock()
+
+	c.sendSpecialFrame("CHAL " + hex.EncodeToString(nonce))
+	return nil
+}
+
+// takeNonce returns the nonce of the pending challenge, if any; each challenge can be answered only once.
+func (c *Client) takeNonce() []byte {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	nonce := c.nonce
+	c.nonce = nil
+	return nonce
+}
+
+// verifyResponse returns the policy of the key used to answer the challenge, or nil if the answer is not valid.
+func (cfg *Config) verifyResponse(nonce []byte, answer string) *Policy {
+	var identity, encoded string
+	fields := strings.Fields(answer)
+	switch len(fields) {
+	case 1:
+		encoded = fields[0]
+	case 2:
+		identity, encoded = fields[0], fields[1]
+	default:
+		return nil
+	}
+	response, err := hex.DecodeString(encoded)
+	if err != nil {
+		return nil
+	}
+
+	var p *Policy
+	if identity == "" {
+		if cfg.AuthKey != "" {
+			p = cfg.defaultPolicy()
+		}
+	} else {
+		p = cfg.identities[identity]
+	}
+	// compute the HMAC even for unknown identities, so that their existence is not disclosed by timing
+	var key string
+	if p != nil {
+		key = p.key
+	}
+	mac := hmac.New(sha256.New, []byte(key))
+	mac.Write(nonce)
+	if !hmac.Equal(mac.Sum(nil), response) || p == nil {
+		return nil
+	}
+	return p
+}
+
+// lookupKey returns the policy of the specified key, or nil if the key is not valid; keys are compared in constant time.
+func (cfg *Config) lookupKey(key string) *Policy {
+	var found *Policy
+	if cfg.AuthKey != "" && subtle.ConstantTimeCompare([]byte(key), []byte(cfg.AuthKey)) == 1 {
+		found = cfg.defaultPolicy()
+	}
+	for k, p := range cfg.keys {
+		if subtle.ConstantTimeCompare([]byte(key), []byte(k)) == 1 {
+			found = p
+		}
+	}
+	return found
+}
@@ -0,0 +1,143 @@
+/* go-websockproxy - https://github.com/gdm85/go-websockproxy
+Copyright (C) 2016 gdm85
+
+This program is free software; you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation; either version 2 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License along
+with this program; if not, write to the Free Software Foundation, Inc.,
+51 Franklin Street, Fifth Floor, Boston, MA 02110-1301 USA.
+*/
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Backpressure works with special frames in both directions: when an upload of the client exceeds its limits the
+// server sends "XOFF <milliseconds> <rate>", asking the client to pause its uploads for that long, followed by
+// "XON <rate>" once the pause is over; the rate is the upload allowance of the client in bytes per second, 0 when it
+// is not limited. The client can send "XOFF [<milliseconds>]" to pause the delivery of frames to it, and "XON" to resume it.
+
+// minBackpressurePause is the shortest pause requested to clients, so that they are not flooded with XOFF frames
+const minBackpressurePause = 10 * time.Millisecond
+
+// flowControl holds the backpressure state of a client.
+type flowControl struct {
+	sync.Mutex
+	// xoff is true while the client is asked to pause its uploads
+	xoff bool
+	// pausedUntil is the end of the pause of the delivery requested by the client
+	pausedUntil time.Time
+	// resumed is signalled when the client resumes the delivery
+	resumed chan struct{}
+}
+
+// requestPause asks the client to pause its uploads until a payload of the specified size conforms to its limits,
+// unless backpressure is disabled or the client was already asked to pause.
+func (c *Client) requestPause(frameLen int, class priorityClass) {
+	if !backpressure {
+		return
+	}
+	fc := &c.flow
+	fc.Lock()
+	if fc.xoff {
+		fc.Unlock()
+		return
+	}
+	fc.xoff = true
+	fc.Unlock()
+
+	pause := wait(frameLen, c.uploadLimits(class))
+	if pause < minBackpressurePause {
+		pause = minBackpressurePause
+	}
+	rate := c.uploadAllowance(class).Bandwidth().rate
+	atomic.AddUint64(&stats.BackpressurePauses, 1)
+	c.sendSpecialFrame(fmt.Sprintf("XOFF %d %d", pause/time.Millisecond, rate))
+	time.AfterFunc(pause, func() {
+		fc.Lock()
+		fc.xoff = false
+		fc.Unlock()
+		if !c.isTerminated() {
+			c.sendSpecialFrame(fmt.Sprintf("XON %d", c.uploadAllowance(class).Bandwidth().rate))
+		}
+	})
+}
+
+// handleFlowControl handles the XOFF and XON special frames sent by the client.
+func (c *Client) handleFlowControl(fields []string) error {
+	if !backpressure {
+		return fmt.Errorf("ignoring %s frame (backpressure disabled on server side)", fields[0])
+	}
+	fc := &c.flow
+	if fields[0] == "XON" {
+		fc.Lock()
+		fc.pausedUntil = time.Time{}
+		fc.Unlock()
+		select {
+		case fc.resumed <- struct{}{}:
+		default:
+		}
+		logLimit.Debug("delivery_resumed", c, "delivery resumed")
+		return nil
+	}
+
+	pause := maxClientPause
+	if len(fields) > 1 {
+		ms, err := strconv.ParseUint(fields[1], 10, 32)
+		if err != nil {
+			return errors.New("invalid XOFF duration: " + fields[1])
+		}
+		if d := time.Duration(ms) * time.Millisecond; d < pause {
+			pause = d
+		}
+	}
+	fc.Lock()
+	fc.pausedUntil = time.Now().Add(pause)
+	fc.Unlock()
+	atomic.AddUint64(&stats.ClientPauses, 1)
+	logLimit.Debug("delivery_paused", c, "delivery paused for %v", pause)
+	return nil
+}
+
+// isPaused returns true if the client paused the delivery of frames.
+func (c *Client) isPaused() bool {
+	c.flow.Lock()
+	defer c.flow.Unlock()
+	return time.Now().Before(c.flow.pausedUntil)
+}
+
+// waitResume waits until the pause of the delivery requested by the client is over, or the client is terminated.
+func (c *Client) waitResume() {
+	fc := &c.flow
+	for {
+		fc.Lock()
+		d := time.Until(fc.pausedUntil)
+		fc.Unlock()
+		if d <= 0 {
+			return
+		}
+		t := time.NewTimer(d)
+		select {
+		case <-c.terminator:
+			t.Stop()
+			return
+		case <-fc.resumed:
+			t.Stop()
+		case <-t.C:
+		}
+	}
+}
@@ -0,0 +1,235 @@
+/* go-websockproxy - https://github.com/gdm85/go-websockproxy
+Copyright (C) 2016 gdm85
+
+This program is free software; you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation; either version 2 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License along
+with this program; if not, write to the Free Software Foundation, Inc.,
+51 Franklin Street, Fifth Floor, Boston, MA 02110-1301 USA.
+*/
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Ban is a ban of a remote address, or of a /64 prefix for IPv6 addresses.
+type Ban struct {
+	Address string `json:"address"`
+	// Until is the expiry of the ban; zero for permanent bans
+	Until  time.Time `json:"until"`
+	Reason string    `json:"reason"`
+}
+
+// offender tracks the incidents caused by a remote address.
+type offender struct {
+	incidents    int
+	bans         int
+	lastIncident time.Time
+}
+
+// BanList tracks failed authorizations and spoofing incidents of remote addresses and bans the addresses causing too many
+// of them, for a duration which doubles with each ban; bans are persisted to a file, if any.
+type BanList struct {
+	sync.Mutex
+	bans      map[string]*Ban
+	offenders map[string]*offender
+	path      string
+}
+
+// NewBanList returns an empty ban list.
+func NewBanList() *BanList {
+	return &BanList{
+		bans:      map[string]*Ban{},
+		offenders: map[string]*offender{},
+	}
+}
+
+// addressKey returns the key under which a remote address ('host:port' or bare host) is tracked for bans and
+// connection limits: its subnet according to the configured prefix lengths, or the address itself for full-length prefixes.
+func addressKey(remoteAddress string) string {
+	host, _, err := net.SplitHostPort(remoteAddress)
+	if err != nil {
+		host = remoteAddress
+	}
+	if i := strings.IndexByte(host, '/'); i != -1 {
+		// already a subnet, e.g. from the ban list file
+		host = host[:i]
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return host
+	}
+	bits, ones := 128, ipv6PrefixLength
+	if ip4 := ip.To4(); ip4 != nil {
+		ip, bits, ones = ip4, 32, ipv4PrefixLength
+	}
+	if ones >= bits {
+		return ip.String()
+	}
+	prefix := &net.IPNet{IP: ip.Mask(net.CIDRMask(ones, bits)), Mask: net.CIDRMask(ones, bits)}
+	return prefix.String()
+}
+
+// Load loads the bans persisted in the file, which is also used for saving them afterwards; a missing file is not an error.
+func (bl *BanList) Load(path string) error {
+	bl.Lock()
+	defer bl.Unlock()
+	bl.path = path
+
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	var bans []*Ban
+	if err := json.Unmarshal(data, &bans); err != nil {
+		return fmt.Errorf("parsing %s: %v", path, err)
+	}
+	for _, b := range bans {
+		bl.bans[addressKey(b.Address)] = b
+	}
+	return nil
+}
+
+// save persists the active bans; ban list must be locked by the caller.
+func (bl *BanList) save() {
+	if bl.path == "" {
+		return
+	}
+	data, err := json.MarshalIndent(bl.active(time.Now()), "", "\t")
+	if err != nil {
+		logConn.Error("ban_list_save_failed", nil, "saving ban list: %v", err)
+		return
+	}
+	tmp := bl.path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0600); err != nil {
+		logConn.Error("ban_list_save_failed", nil, "saving ban list: %v", err)
+		return
+	}
+	if err := os.Rename(tmp, bl.path); err != nil {
+		logConn.Error("ban_list_save_failed", nil, "saving ban list: %v", err)
+	}
+}
+
+// active returns the bans which did not expire, sorted by address; ban list must be locked by the caller.
+func (bl *BanList) active(now time.Time) []*Ban {
+	bans := make([]*Ban, 0, len(bl.bans))
+	for key, b := range bl.bans {
+		if !b.Until.IsZero() && !now.Before(b.Until) {
+			delete(bl.bans, key)
+			continue
+		}
+		bans = append(bans, b)
+	}
+	sort.Slice(bans, func(i, j int) bool { return bans[i].Address < bans[j].Address })
+	return bans
+}
+
+// List returns the active bans.
+func (bl *BanList) List() []*Ban {
+	bl.Lock()
+	defer bl.Unlock()
+	return bl.active(time.Now())
+}
+
+// Banned returns the ban of the remote address, or nil if it is not banned.
+func (bl *BanList) Banned(remoteAddress string) *Ban {
+	bl.Lock()
+	defer bl.Unlock()
+	b, ok := bl.bans[addressKey(remoteAddress)]
+	if !ok {
+		return nil
+	}
+	if !b.Until.IsZero() && !time.Now().Before(b.Until) {
+		return nil
+	}
+	return b
+}
+
+// RecordIncident records a failed authorization or a spoofing attempt from the remote address; it returns true if the
+// address is now banned.
+func (bl *BanList) RecordIncident(remoteAddress, reason string) bool {
+	if banThreshold == 0 {
+		return false
+	}
+	key := addressKey(remoteAddress)
+	now := time.Now()
+
+	bl.Lock()
+	defer bl.Unlock()
+	o, ok := bl.offenders[key]
+	if !ok || now.Sub(o.lastIncident) > maxBanDuration {
+		// offenders are forgiven after a long enough period of good behaviour
+		o = &offender{}
+		bl.offenders[key] = o
+	}
+	o.incidents++
+	o.lastIncident = now
+	if o.incidents < banThreshold {
+		return false
+	}
+
+	duration := banDuration << uint(o.bans)
+	if duration > maxBanDuration || duration <= 0 {
+		duration = maxBanDuration
+	}
+	o.incidents = 0
+	o.bans++
+	bl.bans[key] = &Ban{Address: key, Until: now.Add(duration), Reason: reason}
+	bl.save()
+	logConn.Warning("address_banned", nil, "banned %s for %v after repeated incidents (%s)", key, duration, reason)
+	return true
+}
+
+// Add bans an address for the specified duration, or permanently if the duration is zero; an existing ban of the
+// address is replaced.
+func (bl *BanList) Add(address string, duration time.Duration, reason string) *Ban {
+	key := addressKey(address)
+	b := &Ban{Address: key, Reason: reason}
+	if duration != 0 {
+		b.Until = time.Now().Add(duration)
+	}
+	bl.Lock()
+	defer bl.Unlock()
+	bl.bans[key] = b
+	bl.save()
+	if duration == 0 {
+		logConn.Info("address_banned", nil, "banned %s permanently (%s)", key, reason)
+	} else {
+		logConn.Info("address_banned", nil, "banned %s for %v (%s)", key, duration, reason)
+	}
+	return b
+}
+
+// Lift removes the ban of an address and forgets its incidents; it returns false if the address was not banned.
+func (bl *BanList) Lift(address string) bool {
+	key := addressKey(address)
+	bl.Lock()
+	defer bl.Unlock()
+	delete(bl.offenders, key)
+	if _, ok := bl.bans[key]; !ok {
+		return false
+	}
+	delete(bl.bans, key)
+	bl.save()
+	logConn.Info("ban_lifted", nil, "lifted ban of %s", key)
+	return true
+}
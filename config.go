@@ -0,0 +1,271 @@
+/* go-websockproxy - https://github.com/gdm85/go-websockproxy
+Copyright (C) 2016 gdm85
+
+This program is free software; you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation; either version 2 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License along
+with this program; if not, write to the Free Software Foundation, Inc.,
+51 Franklin Street, Fifth Floor, Boston, MA 02110-1301 USA.
+*/
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+	"strings"
+)
+
+// Config holds the settings that can be changed at runtime by reloading the configuration.
+// Command-line options provide the defaults, which are overridden by the options specified in the configuration file.
+type Config struct {
+	AuthKey              string `json:"auth-key"`
+	MACPrefix            string `json:"mac-prefix"`
+	MaxUploadBandwidth   string `json:"max-upload-bandwidth"`
+	MaxDownloadBandwidth string `json:"max-download-bandwidth"`
+	MaxControlBandwidth  string `json:"max-control-bandwidth"`
+	MaxQueuedBytes       int64  `json:"max-queued-bytes"`
+	KeyFile              string `json:"auth-key-file"`
+	TokenSecret          string `json:"token-secret"`
+	ClientCRLFile        string `json:"client-crl-file"`
+	AuthWebhook          string `json:"auth-webhook"`
+	Quota                string `json:"quota"`
+
+	MaxIdentityUploadBandwidth   string `json:"max-identity-upload-bandwidth"`
+	MaxIdentityDownloadBandwidth string `json:"max-identity-download-bandwidth"`
+	MaxNetworkUploadBandwidth    string `json:"max-network-upload-bandwidth"`
+	MaxNetworkDownloadBandwidth  string `json:"max-network-download-bandwidth"`
+	MaxTotalUploadBandwidth      string `json:"max-total-upload-bandwidth"`
+	MaxTotalDownloadBandwidth    string `json:"max-total-download-bandwidth"`
+
+	uploadBandwidth, downloadBandwidth, controlBandwidth Bandwidth
+	quota                                                int64
+	// bandwidths shared by the clients of an identity, of a network and by all clients
+	identityUploadBandwidth, identityDownloadBandwidth Bandwidth
+	networkUploadBandwidth, networkDownloadBandwidth   Bandwidth
+	totalUploadBandwidth, totalDownloadBandwidth       Bandwidth
+	// policies of the key file entries, by key and by identity
+	keys, identities map[string]*Policy
+	// identities of the MAC addresses reserved in the key file
+	reservedMACs map[string]string
+	// revoked client certificates, by issuer and serial number
+	revoked map[certificateID]bool
+}
+
+// loadConfig returns the configuration specified via command-line options and the eventual configuration file.
+func loadConfig() (*Config, error) {
+	cfg := &Config{
+		AuthKey:              authKey,
+		MACPrefix:            macPrefix,
+		MaxUploadBandwidth:   maxUploadBandwidth,
+		MaxDownloadBandwidth: maxDownloadBandwidth,
+		MaxControlBandwidth:  maxControlBandwidth,
+		MaxQueuedBytes:       maxQueuedBytes,
+		KeyFile:              authKeyFile,
+		TokenSecret:          tokenSecret,
+		ClientCRLFile:        clientCRLFile,
+		AuthWebhook:          authWebhook,
+		Quota:                quota,
+
+		MaxIdentityUploadBandwidth:   maxIdentityUploadBandwidth,
+		MaxIdentityDownloadBandwidth: maxIdentityDownloadBandwidth,
+		MaxNetworkUploadBandwidth:    maxNetworkUploadBandwidth,
+		MaxNetworkDownloadBandwidth:  maxNetworkDownloadBandwidth,
+		MaxTotalUploadBandwidth:      maxTotalUploadBandwidth,
+		MaxTotalDownloadBandwidth:    maxTotalDownloadBandwidth,
+	}
+
+	if configFile != "" {
+		f, err := os.Open(configFile)
+		if err != nil {
+			return nil, err
+		}
+		dec := json.NewDecoder(f)
+		dec.DisallowUnknownFields()
+		err = dec.Decode(cfg)
+		f.Close()
+		if err != nil {
+			return nil, fmt.Errorf("parsing %s: %v", configFile, err)
+		}
+	}
+
+	if cfg.MaxQueuedBytes < 0 {
+		return nil, errors.New("invalid max queued bytes specified")
+	}
+
+	var err error
+	cfg.uploadBandwidth, err = parseBandwidth(cfg.MaxUploadBandwidth)
+	if err != nil {
+		return nil, fmt.Errorf("invalid upload bandwidth specified: %v", err)
+	}
+	cfg.downloadBandwidth, err = parseBandwidth(cfg.MaxDownloadBandwidth)
+	if err != nil {
+		return nil, fmt.Errorf("invalid download bandwidth specified: %v", err)
+	}
+	cfg.controlBandwidth, err = parseBandwidth(cfg.MaxControlBandwidth)
+	if err != nil {
+		return nil, fmt.Errorf("invalid control bandwidth specified: %v", err)
+	}
+	cfg.quota, err = parseQuota(cfg.Quota)
+	if err != nil {
+		return nil, fmt.Errorf("invalid quota specified: %v", err)
+	}
+	for _, ab := range cfg.aggregateBandwidths() {
+		*ab.bandwidth, err = parseBandwidth(ab.spec)
+		if err != nil {
+			return nil, fmt.Errorf("invalid %s bandwidth specified: %v", ab.name, err)
+		}
+	}
+
+	if cfg.KeyFile != "" {
+		if err := cfg.loadKeyFile(); err != nil {
+			return nil, err
+		}
+	}
+	if cfg.ClientCRLFile != "" {
+		if err := cfg.loadCRL(); err != nil {
+			return nil, err
+		}
+	}
+
+	return cfg, nil
+}
+
+// aggregateBandwidth is the specification and the parsed value of one of the bandwidths shared by a group of clients.
+type aggregateBandwidth struct {
+	name      string
+	spec      string
+	bandwidth *Bandwidth
+}
+
+// aggregateBandwidths returns the bandwidths shared by groups of clients.
+func (cfg *Config) aggregateBandwidths() []aggregateBandwidth {
+	return []aggregateBandwidth{
+		{"identity upload", cfg.MaxIdentityUploadBandwidth, &cfg.identityUploadBandwidth},
+		{"identity download", cfg.MaxIdentityDownloadBandwidth, &cfg.identityDownloadBandwidth},
+		{"network upload", cfg.MaxNetworkUploadBandwidth, &cfg.networkUploadBandwidth},
+		{"network download", cfg.MaxNetworkDownloadBandwidth, &cfg.networkDownloadBandwidth},
+		{"total upload", cfg.MaxTotalUploadBandwidth, &cfg.totalUploadBandwidth},
+		{"total download", cfg.MaxTotalDownloadBandwidth, &cfg.totalDownloadBandwidth},
+	}
+}
+
+// reloadConfig loads the configuration again and applies it to the hub; it returns a report of what changed.
+func reloadConfig() ([]string, error) {
+	cfg, err := loadConfig()
+	if err != nil {
+		return nil, err
+	}
+	report := hub.ApplyConfig(cfg)
+	if len(report) == 0 {
+		logMain.Info("config_reloaded", nil, "configuration reloaded, nothing changed")
+	} else {
+		logMain.Info("config_reloaded", nil, "configuration reloaded: %s", strings.Join(report, "; "))
+	}
+	return report, nil
+}
+
+// diff returns a description of the settings that differ from the other configuration; the auth key is never disclosed.
+func (cfg *Config) diff(old *Config) []string {
+	var changes []string
+	if cfg.AuthKey != old.AuthKey {
+		switch {
+		case old.AuthKey == "":
+			changes = append(changes, "authorization enabled")
+		case cfg.AuthKey == "":
+			changes = append(changes, "authorization disabled")
+		default:
+			changes = append(changes, "auth key changed")
+		}
+	}
+	if cfg.TokenSecret != old.TokenSecret {
+		switch {
+		case old.TokenSecret == "":
+			changes = append(changes, "access tokens enabled")
+		case cfg.TokenSecret == "":
+			changes = append(changes, "access tokens disabled")
+		default:
+			changes = append(changes, "token secret changed")
+		}
+	}
+	if cfg.AuthWebhook != old.AuthWebhook {
+		changes = append(changes, fmt.Sprintf("authorization webhook changed from %q to %q", redactURL(old.AuthWebhook), redactURL(cfg.AuthWebhook)))
+	}
+	if cfg.ClientCRLFile != old.ClientCRLFile {
+		changes = append(changes, fmt.Sprintf("client CRL file changed from %q to %q", old.ClientCRLFile, cfg.ClientCRLFile))
+	}
+	for id := range cfg.revoked {
+		if !old.revoked[id] {
+			changes = append(changes, fmt.Sprintf("client certificate %v revoked", id))
+		}
+	}
+	if cfg.MACPrefix != old.MACPrefix {
+		changes = append(changes, fmt.Sprintf("MAC prefix changed from %q to %q", old.MACPrefix, cfg.MACPrefix))
+	}
+	if cfg.uploadBandwidth != old.uploadBandwidth {
+		changes = append(changes, fmt.Sprintf("upload bandwidth changed from %v to %v", old.uploadBandwidth, cfg.uploadBandwidth))
+	}
+	if cfg.downloadBandwidth != old.downloadBandwidth {
+		changes = append(changes, fmt.Sprintf("download bandwidth changed from %v to %v", old.downloadBandwidth, cfg.downloadBandwidth))
+	}
+	if cfg.controlBandwidth != old.controlBandwidth {
+		changes = append(changes, fmt.Sprintf("control bandwidth changed from %v to %v", old.controlBandwidth, cfg.controlBandwidth))
+	}
+	oldAggregates := old.aggregateBandwidths()
+	for i, ab := range cfg.aggregateBandwidths() {
+		if *ab.bandwidth != *oldAggregates[i].bandwidth {
+			changes = append(changes, fmt.Sprintf("%s bandwidth changed from %v to %v", ab.name, *oldAggregates[i].bandwidth, *ab.bandwidth))
+		}
+	}
+	if cfg.quota != old.quota {
+		changes = append(changes, fmt.Sprintf("traffic quota changed from %d to %d bytes", old.quota, cfg.quota))
+	}
+	if cfg.MaxQueuedBytes != old.MaxQueuedBytes {
+		changes = append(changes, fmt.Sprintf("max queued bytes changed from %d to %d", old.MaxQueuedBytes, cfg.MaxQueuedBytes))
+	}
+	if cfg.KeyFile != old.KeyFile {
+		changes = append(changes, fmt.Sprintf("auth key file changed from %q to %q", old.KeyFile, cfg.KeyFile))
+	}
+	for identity, p := range cfg.identities {
+		op, ok := old.identities[identity]
+		switch {
+		case !ok:
+			changes = append(changes, fmt.Sprintf("key added for identity %q", identity))
+		case op.key != p.key:
+			changes = append(changes, fmt.Sprintf("key changed for identity %q", identity))
+		case *op != *p:
+			changes = append(changes, fmt.Sprintf("policy changed for identity %q", identity))
+		}
+	}
+	for identity := range old.identities {
+		if _, ok := cfg.identities[identity]; !ok {
+			changes = append(changes, fmt.Sprintf("key removed for identity %q", identity))
+		}
+	}
+	return changes
+}
+
+// redactURL returns the URL with its user information and query string masked, since they may hold credentials.
+func redactURL(s string) string {
+	u, err := url.Parse(s)
+	if err != nil {
+		return "(invalid URL)"
+	}
+	if u.User != nil {
+		u.User = url.User("xxxxx")
+	}
+	if u.RawQuery != "" {
+		u.RawQuery = "xxxxx"
+	}
+	return u.String()
+}
@@ -0,0 +1,181 @@
+/* go-websockproxy - https://github.com/gdm85/go-websockproxy
+Copyright (C) 2016 gdm85
+
+This program is free software; you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation; either version 2 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License along
+with this program; if not, write to the Free Software Foundation, Inc.,
+51 Franklin Street, Fifth Floor, Boston, MA 02110-1301 USA.
+*/
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/net/websocket"
+)
+
+// name of the cookie which can carry the credential during the websocket handshake
+const authCookieName = "wstap_auth"
+
+type contextKey int
+
+// policyContextKey is the request context key of the policy of clients authenticated during the handshake
+const policyContextKey contextKey = iota
+
+// wstapHandler handles the HTTP requests for websocket connections, eventually authenticating them before the upgrade.
+type wstapHandler struct {
+	ws websocket.Handler
+}
+
+// newWstapHandler returns the handler of websocket connections at '/wstap'.
+func newWstapHandler() http.Handler {
+	return wstapHandler{ws: websocket.Handler(websocketHandler)}
+}
+
+func (h wstapHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if b := bans.Banned(r.RemoteAddr); b != nil {
+		logConn.Info("handshake_banned", nil, "refusing websocket handshake from banned %s", r.RemoteAddr)
+		msg := "banned"
+		if !b.Until.IsZero() {
+			msg = "banned until " + b.Until.Format(time.RFC3339)
+			w.Header().Set("Retry-After", strconv.Itoa(int(time.Until(b.Until).Seconds())+1))
+		}
+		atomic.AddUint64(&stats.HandshakesBanned, 1)
+		http.Error(w, msg, http.StatusForbidden)
+		return
+	}
+
+	if err := hub.CheckConnectionLimits(r.RemoteAddr); err != nil {
+		logConn.Info("handshake_limited", nil, "refusing websocket handshake from %s: %v", r.RemoteAddr, err)
+		status := http.StatusServiceUnavailable
+		if err == errTooManyClientsFromAddress {
+			status = http.StatusTooManyRequests
+		}
+		atomic.AddUint64(&stats.HandshakesLimited, 1)
+		http.Error(w, err.Error(), status)
+		return
+	}
+
+	if err := checkOrigin(r.Header.Get("Origin"), hub.Config()); err != nil {
+		logConn.Warning("handshake_origin_not_allowed", nil, "refusing websocket handshake from %s: origin %q not allowed", r.RemoteAddr, r.Header.Get("Origin"))
+		atomic.AddUint64(&stats.HandshakesOriginRejected, 1)
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
+
+	if handshakeAuth {
+		policy, status, err := authenticateRequest(r)
+		if err != nil {
+			logAuth.Info("handshake_unauthorized", nil, "refusing websocket handshake from %s: %v", r.RemoteAddr, err)
+			if status == http.StatusForbidden && err != errTooManySessions {
+				bans.RecordIncident(r.RemoteAddr, "failed authorization")
+			}
+			if status == http.StatusUnauthorized {
+				w.Header().Set("WWW-Authenticate", `Bearer realm="wstap"`)
+			}
+			if status == http.StatusServiceUnavailable {
+				atomic.AddUint64(&stats.HandshakesUnavailable, 1)
+			} else {
+				atomic.AddUint64(&stats.HandshakesUnauthorized, 1)
+			}
+			http.Error(w, err.Error(), status)
+			return
+		}
+		if policy != nil {
+			r = r.WithContext(context.WithValue(r.Context(), policyContextKey, policy))
+		}
+	}
+	h.ws.ServeHTTP(w, r)
+}
+
+// requestCredential returns the credential presented with the request, either in the Authorization header as bearer,
+// in the authorization cookie or in the 'token' query parameter.
+func requestCredential(r *http.Request) string {
+	if auth := r.Header.Get("Authorization"); strings.HasPrefix(auth, "Bearer ") {
+		return strings.TrimSpace(auth[len("Bearer "):])
+	}
+	if cookie, err := r.Cookie(authCookieName); err == nil && cookie.Value != "" {
+		return cookie.Value
+	}
+	return r.URL.Query().Get("token")
+}
+
+// authenticateRequest verifies the credential presented with the websocket handshake request and returns the policy of the
+// client, nil if authorization is disabled; in case of error, the HTTP status code for the rejection is returned as well.
+func authenticateRequest(r *http.Request) (*Policy, int, error) {
+	cfg := hub.Config()
+	if !cfg.authRequired() {
+		return nil, 0, nil
+	}
+
+	if cert := requestCertificate(r); cert != nil {
+		policy := cfg.certificatePolicy(cert)
+		if policy == nil {
+			return nil, http.StatusForbidden, errors.New("client certificate without identity")
+		}
+		if !hub.canStartSession(policy) {
+			return nil, http.StatusForbidden, errTooManySessions
+		}
+		return policy, 0, nil
+	}
+
+	credential := requestCredential(r)
+	if credential == "" {
+		return nil, http.StatusUnauthorized, errors.New("missing credential")
+	}
+
+	var policy *Policy
+	if cfg.TokenSecret != "" && isToken(credential) {
+		var err error
+		policy, err = cfg.verifyToken(credential, time.Now())
+		if err != nil {
+			return nil, http.StatusForbidden, err
+		}
+	} else if !allowPlainAuth {
+		// the webhook too verifies credentials sent in clear
+		return nil, http.StatusForbidden, errors.New("keys in clear are not accepted")
+	} else if cfg.AuthWebhook != "" && cfg.lookupKey(credential) == nil {
+		var err error
+		policy, err = cfg.webhookPolicy(credential, r.RemoteAddr, requestedVLAN(r))
+		if err == errWebhookUnavailable {
+			return nil, http.StatusServiceUnavailable, err
+		}
+		if err != nil {
+			return nil, http.StatusForbidden, err
+		}
+	} else {
+		policy = cfg.lookupKey(credential)
+		if policy == nil {
+			return nil, http.StatusForbidden, errors.New("AUTH key not accepted")
+		}
+		if policy.Expired(time.Now()) {
+			return nil, http.StatusForbidden, errKeyExpired
+		}
+	}
+
+	if !hub.canStartSession(policy) {
+		return nil, http.StatusForbidden, errTooManySessions
+	}
+	return policy, 0, nil
+}
+
+// requestPolicy returns the policy of a client authenticated during the websocket handshake, if any.
+func requestPolicy(r *http.Request) *Policy {
+	p, _ := r.Context().Value(policyContextKey).(*Policy)
+	return p
+}
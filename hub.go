@@ -21,8 +21,10 @@ import (
 	"errors"
 	"fmt"
 	"net"
+	"sort"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/songgao/water/waterutil"
@@ -36,14 +38,33 @@ const (
 // Client is a websocket client managed by a Hub.
 type Client struct {
 	upload, download BandwidthAllowance
-	remoteAddress    string
-	ws               *websocket.Conn
-	authorized       bool
-
-	frameReceiver chan ([]byte)
-	terminator    chan (bool)
+	// separate allowances for control traffic, which is not limited when their rate is zero
+	uploadControl, downloadControl BandwidthAllowance
+	id                             uint64
+	remoteAddress                  string
+	ws                             *websocket.Conn
+	hub                            *Hub
+
+	// mu protects the fields below, which can be changed by a configuration reload
+	mu         sync.Mutex
+	authorized bool
+	policy     *Policy
+	expiry     *time.Timer
+	nonce      []byte // nonce of the pending authorization challenge
+	degraded   bool   // only control traffic is delivered
+	// limited to the fallback bandwidth because the quota of its identity is exceeded
+	quotaThrottled bool
+	// bandwidth limits set through the administrative interface, overriding those of the policy when not nil
+	uploadOverride, downloadOverride *Bandwidth
+
+	frames     *frameQueue
+	terminator chan (bool)
+	terminated sync.Once
 
 	mac net.HardwareAddr
+
+	storm stormControl
+	flow  flowControl
 }
 
 // Hub is a websocket clients manager.
@@ -51,34 +72,52 @@ type Hub struct {
 	sync.Mutex
 	clients      map[*websocket.Conn]*Client
 	clientsByMAC map[string]*Client
+	shuttingDown bool
+	config       *Config
+	lastClientID uint64
+	queuedBytes  int64 // total size of the frames queued for delivery to all clients, updated atomically
 }
 
+var (
+	// errShuttingDown is returned when a client is added to a hub that is shutting down.
+	errShuttingDown = errors.New("server is shutting down")
+	// errTooManyClients is returned when a client is added to a hub that reached the max number of clients.
+	errTooManyClients = errors.New("too many clients connected")
+	// errTooManyClientsFromAddress is returned when a client is added from a remote address which reached the max number of clients.
+	errTooManyClientsFromAddress = errors.New("too many clients connected from this address")
+)
+
 // RateLimiter is an interface to limit upload and/or download bandwidths.
 type RateLimiter interface {
-	UploadThrottle(frameLen int) bool
-	DownloadThrottle(frameLen int) bool
+	UploadThrottle(frameLen int, class priorityClass) bool
+	DownloadThrottle(frameLen int, class priorityClass) bool
 }
 
 // Add will add a client to the hub and initialize its frames delivery and eventual bandwidth limiting features.
-func (h *Hub) Add(ws *websocket.Conn) *Client {
+func (h *Hub) Add(ws *websocket.Conn) (*Client, error) {
 	h.Lock()
+	if h.shuttingDown {
+		h.Unlock()
+		return nil, errShuttingDown
+	}
+	if err := h.checkConnectionLimits(ws.Request().RemoteAddr); err != nil {
+		h.Unlock()
+		return nil, err
+	}
+	h.lastClientID++
 	c := &Client{
+		id:            h.lastClientID,
 		remoteAddress: ws.Request().RemoteAddr,
 		ws:            ws,
-		authorized:    authKey == "", // pre-authorize all clients when authorization is disabled
-		frameReceiver: make(chan []byte, defaultFrameBufferSize),
+		hub:           h,
+		frames:        newFrameQueue(defaultFrameBufferSize, priorityWeights, &h.queuedBytes),
 		terminator:    make(chan bool),
 	}
-	if uploadBandwidth != 0 {
-		c.upload.rate = uploadBandwidth
-		c.upload.allowance = uploadBandwidth
-		c.upload.lastCheck = time.Now()
-	}
-	if downloadBandwidth != 0 {
-		c.download.rate = downloadBandwidth
-		c.download.allowance = downloadBandwidth
-		c.download.lastCheck = time.Now()
-	}
+	c.flow.resumed = make(chan struct{}, 1)
+	// pre-authorize all clients when authorization is disabled
+	c.setPolicy(h.config.defaultPolicy(), !h.config.authRequired())
+	c.storm.packets.SetRate(Bandwidth{rate: maxPacketsPerSecond})
+	c.storm.broadcasts.SetRate(Bandwidth{rate: maxBroadcastsPerSecond})
 
 	h.clients[ws] = c
 	h.Unlock()
@@ -86,48 +125,291 @@ func (h *Hub) Add(ws *websocket.Conn) *Client {
 	go func() {
 		err := c.deliverFrames()
 		if err != nil {
-			ErrorPrintf("client %v: dropping client because of error during send: %v", c, err)
+			logSwitch.Error("send_failed", c, "dropping client because of error during send: %v", err)
+			if ne, ok := err.(net.Error); ok && ne.Timeout() {
+				atomic.AddUint64(&stats.WriteTimeouts, 1)
+				c.Close(closePolicyViolation, "slow consumer: write timeout")
+			}
 			h.Remove(c)
 		}
 	}()
 
-	return c
+	return c, nil
 }
 
-// deliverFrames delivers the frames buffered in the receiving channel.
+// deliverFrames delivers the frames buffered in the receiving queue, according to their priority.
 func (c *Client) deliverFrames() error {
 	for {
 		select {
 		case <-c.terminator:
-			DebugPrintf("client %v: terminated delivery of received frames (%d pending)", len(c.frameReceiver))
+			logSwitch.Debug("delivery_terminated", c, "terminated delivery of received frames (%d pending)", c.frames.Len())
 			return nil
-		case frame := <-c.frameReceiver:
-			if c.DownloadThrottle(len(frame)) {
-				WarningPrintf("client %v, frame %v: discarding because of download rate limiting", c, frame)
+		case <-c.frames.ready:
+		}
+
+		for !c.isTerminated() {
+			c.waitResume()
+			frame, class, ok := c.frames.Pop()
+			if !ok {
+				break
+			}
+			if !isSpecialFrame(frame) && c.DownloadThrottle(len(frame), class) {
+				atomic.AddUint64(&stats.DownloadRateLimitDrops, 1)
+				logLimit.Warning("download_rate_limit_drop", c, "frame %v: discarding because of download rate limiting", Frame(frame))
 			} else {
+				if writeTimeout != 0 {
+					c.ws.SetWriteDeadline(time.Now().Add(writeTimeout))
+				}
 				err := websocket.Message.Send(c.ws, frame)
 				if err != nil {
 					return err
 				}
-				DebugPrintf("client %v, frame %v: sent", c, frame)
+				if !isSpecialFrame(frame) {
+					c.accountTraffic(len(frame))
+					metrics.CountTraffic(c, directionDownload, len(frame))
+				}
+				logSwitch.Debug("frame_sent", c, "frame %v: sent", Frame(frame))
 			}
 		}
 	}
 }
 
-// UploadThrottle returns true if the payload should be throttled.
-func (c *Client) UploadThrottle(frameLen int) bool {
-	return c.upload.DoThrottle(frameLen)
+// terminate stops the delivery of received frames; it is safe to call it multiple times.
+func (c *Client) terminate() {
+	c.terminated.Do(func() {
+		close(c.terminator)
+	})
 }
 
-// DownloadThrottle returns true if the payload should be throttled.
-func (c *Client) DownloadThrottle(frameLen int) bool {
-	return c.download.DoThrottle(frameLen)
+// isTerminated returns true if the delivery of received frames was stopped.
+func (c *Client) isTerminated() bool {
+	select {
+	case <-c.terminator:
+		return true
+	default:
+		return false
+	}
+}
+
+// uploadAllowance returns the upload allowance for the traffic class; control traffic has a separate allowance.
+func (c *Client) uploadAllowance(class priorityClass) *BandwidthAllowance {
+	if class == priorityControl {
+		return &c.uploadControl
+	}
+	return &c.upload
+}
+
+// downloadAllowance returns the download allowance for the traffic class; control traffic has a separate allowance.
+func (c *Client) downloadAllowance(class priorityClass) *BandwidthAllowance {
+	if class == priorityControl {
+		return &c.downloadControl
+	}
+	return &c.download
+}
+
+// uploadLimits returns the limits applying to an upload of the client: its own allowance and, except for control
+// traffic, the limits of its identity, network and of the whole proxy.
+func (c *Client) uploadLimits(class priorityClass) []limiter {
+	limits := []limiter{c.uploadAllowance(class)}
+	if class != priorityControl {
+		limits = append(limits, aggregates.Upload(c)...)
+	}
+	return limits
+}
+
+// downloadLimits returns the limits applying to a download of the client, like uploadLimits.
+func (c *Client) downloadLimits(class priorityClass) []limiter {
+	limits := []limiter{c.downloadAllowance(class)}
+	if class != priorityControl {
+		limits = append(limits, aggregates.Download(c)...)
+	}
+	return limits
+}
+
+// UploadThrottle returns true if the payload exceeds the upload limits and should be throttled (dropped) without delay.
+func (c *Client) UploadThrottle(frameLen int, class priorityClass) bool {
+	return throttle(frameLen, c.uploadLimits(class))
+}
+
+// DownloadThrottle returns true if the payload should be throttled; in shaping mode the delivery is delayed until the
+// payload conforms to the limits, and it is throttled only if the delay would exceed the max shaping delay.
+func (c *Client) DownloadThrottle(frameLen int, class priorityClass) bool {
+	if rateLimitMode == "shape" {
+		return !c.shape(c.downloadLimits(class), frameLen)
+	}
+	return throttle(frameLen, c.downloadLimits(class))
+}
+
+// LimitUpload applies the upload limits of the client to an uploaded payload, whatever its destination (TAP interface
+// or other clients): in shaping mode the caller is delayed until the payload conforms, otherwise the payload is checked
+// without delay. It returns false if the payload should be dropped.
+func (c *Client) LimitUpload(frameLen int, class priorityClass) bool {
+	var ok bool
+	if rateLimitMode == "shape" {
+		ok = c.shape(c.uploadLimits(class), frameLen)
+	} else {
+		ok = !c.UploadThrottle(frameLen, class)
+	}
+	if !ok {
+		c.requestPause(frameLen, class)
+	}
+	return ok
+}
+
+// shape waits until a payload conforms to the limits; it returns false if the delay would exceed the max shaping
+// delay or the client is terminated in the meantime.
+func (c *Client) shape(limits []limiter, frameLen int) bool {
+	delay, ok := reserve(frameLen, maxShapingDelay, limits)
+	if !ok {
+		return false
+	}
+	if delay == 0 {
+		return true
+	}
+	t := time.NewTimer(delay)
+	defer t.Stop()
+	select {
+	case <-c.terminator:
+		return false
+	case <-t.C:
+		return true
+	}
+}
+
+// UplinkWeight returns the weight of the client in the scheduling of the frames written to the TAP interface.
+func (c *Client) UplinkWeight() int {
+	if w := c.Policy().uplinkWeight; w > 0 {
+		return w
+	}
+	return 1
+}
+
+// isAuthorized returns true if the client can send TAP traffic.
+func (c *Client) isAuthorized() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.authorized
+}
+
+// Policy returns the policy currently applied to the client.
+func (c *Client) Policy() *Policy {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.policy
+}
+
+// setPolicy sets the authorization state and the policy of the client, updating its bandwidth limits and
+// scheduling its disconnection when the policy expires.
+func (c *Client) setPolicy(p *Policy, authorized bool) {
+	c.mu.Lock()
+	c.policy = p
+	c.authorized = authorized
+	if c.expiry != nil {
+		c.expiry.Stop()
+		c.expiry = nil
+	}
+	if authorized && !p.Expires.IsZero() {
+		c.expiry = time.AfterFunc(time.Until(p.Expires), func() { c.expire(p) })
+	}
+	c.mu.Unlock()
+
+	c.applyRates(p)
+}
+
+// applyRates sets the bandwidth limits of the client according to its policy, limiting them to the quota fallback
+// bandwidth when the quota of its identity is exceeded.
+func (c *Client) applyRates(p *Policy) {
+	upload, download := p.uploadBandwidth, p.downloadBandwidth
+	c.mu.Lock()
+	if c.uploadOverride != nil {
+		upload = *c.uploadOverride
+	}
+	if c.downloadOverride != nil {
+		download = *c.downloadOverride
+	}
+	c.mu.Unlock()
+	throttled := quotaAction == "throttle" && quotas.Exceeded(p.Identity, p.quota)
+	if throttled {
+		if upload.Unlimited() || upload.rate > quotaFallbackBandwidth.rate {
+			upload = quotaFallbackBandwidth
+		}
+		if download.Unlimited() || download.rate > quotaFallbackBandwidth.rate {
+			download = quotaFallbackBandwidth
+		}
+	}
+	c.mu.Lock()
+	c.quotaThrottled = throttled
+	c.mu.Unlock()
+
+	c.upload.SetRate(upload)
+	c.download.SetRate(download)
+	c.uploadControl.SetRate(p.controlBandwidth)
+	c.downloadControl.SetRate(p.controlBandwidth)
+}
+
+// OverrideRates replaces the upload and download bandwidth limits of the client's policy, until the client disconnects;
+// a nil bandwidth keeps the current override, if any. The limits are changed immediately, without reconnecting.
+func (c *Client) OverrideRates(upload, download *Bandwidth) {
+	c.mu.Lock()
+	if upload != nil {
+		c.uploadOverride = upload
+	}
+	if download != nil {
+		c.downloadOverride = download
+	}
+	p := c.policy
+	c.mu.Unlock()
+
+	c.applyRates(p)
+	logLimit.Info("rates_overridden", c, "bandwidth limits set to %v upload, %v download", c.upload.Bandwidth(), c.download.Bandwidth())
+}
+
+// ResetRates restores the bandwidth limits of the client's policy; it returns false if they were not overridden.
+func (c *Client) ResetRates() bool {
+	c.mu.Lock()
+	overridden := c.uploadOverride != nil || c.downloadOverride != nil
+	c.uploadOverride, c.downloadOverride = nil, nil
+	p := c.policy
+	c.mu.Unlock()
+	if !overridden {
+		return false
+	}
+
+	c.applyRates(p)
+	logLimit.Info("rates_restored", c, "bandwidth limits restored to %v upload, %v download", c.upload.Bandwidth(), c.download.Bandwidth())
+	return true
+}
+
+// RatesOverridden returns true if the bandwidth limits of the client's policy are overridden.
+func (c *Client) RatesOverridden() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.uploadOverride != nil || c.downloadOverride != nil
+}
+
+// expire disconnects the client if it is still authorized with the specified policy.
+func (c *Client) expire(p *Policy) {
+	c.mu.Lock()
+	current := c.authorized && c.policy == p
+	c.mu.Unlock()
+	if !current || c.isTerminated() {
+		return
+	}
+
+	logAuth.Info("credential_expired", c, "credential expired")
+	c.Close(closePolicyViolation, "credential expired")
+	c.hub.Remove(c)
 }
 
 // String returns a human-readable descriptive text of the client.
 func (c *Client) String() string {
-	return fmt.Sprintf("{remote=%s mac=%v authorized=%v pendingFrames=%d}", c.remoteAddress, c.mac, c.authorized, len(c.frameReceiver))
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	var identity string
+	if c.authorized && c.policy.Identity != "" {
+		identity = " identity=" + c.policy.Identity
+	}
+	return fmt.Sprintf("{id=%d%s remote=%s mac=%v authorized=%v pendingFrames=%d}", c.id, identity, c.remoteAddress, c.mac, c.authorized, c.frames.Len())
 }
 
 // Remove will remove the client from the hub and terminate its delivery goroutine.
@@ -135,40 +417,283 @@ func (h *Hub) Remove(c *Client) {
 	h.Lock()
 	if _, ok := h.clients[c.ws]; ok {
 		// stop delivery of messages
-		c.terminator <- true
+		c.terminate()
+		c.frames.Clear()
 
 		delete(h.clients, c.ws)
-		if c.mac.String() != "" {
-			delete(h.clientsByMAC, c.mac.String())
+		if mac := c.MAC(); mac != nil {
+			delete(h.clientsByMAC, mac.String())
 		}
-		DebugPrintf("deleted client %v", c)
+		uplink.Remove(c)
+		impairments.ClearClient(c.id)
+		logConn.Debug("client_removed", c, "deleted client")
 	}
 	h.Unlock()
 }
 
+// List returns all clients, sorted by id.
+func (h *Hub) List() []*Client {
+	h.Lock()
+	defer h.Unlock()
+	clients := make([]*Client, 0, len(h.clients))
+	for _, c := range h.clients {
+		clients = append(clients, c)
+	}
+	sort.Slice(clients, func(i, j int) bool { return clients[i].id < clients[j].id })
+	return clients
+}
+
+// Client returns the client with the specified id, or nil if there is no such client.
+func (h *Hub) Client(id uint64) *Client {
+	h.Lock()
+	defer h.Unlock()
+	for _, c := range h.clients {
+		if c.id == id {
+			return c
+		}
+	}
+	return nil
+}
+
 // Clear will remove all clients and terminate their delivery goroutines.
 func (h *Hub) Clear() {
 	h.Lock()
 	for _, c := range h.clients {
 		// stop delivery of messages
-		c.terminator <- true
-		DebugPrintf("deleted client %v", c)
+		c.terminate()
+		c.frames.Clear()
+		uplink.Remove(c)
+		impairments.ClearClient(c.id)
+		logConn.Debug("client_removed", c, "deleted client")
 	}
 	h.clients = map[*websocket.Conn]*Client{}
 	h.clientsByMAC = map[string]*Client{}
 	h.Unlock()
 }
 
+// Shutdown stops accepting new clients, waits until the specified deadline for the frames pending delivery to each client
+// and finally closes all websocket connections with the specified reason.
+func (h *Hub) Shutdown(deadline time.Time, reason string) {
+	h.Lock()
+	h.shuttingDown = true
+	clients := make([]*Client, 0, len(h.clients))
+	for _, c := range h.clients {
+		clients = append(clients, c)
+	}
+	h.Unlock()
+
+	var wg sync.WaitGroup
+	for _, c := range clients {
+		wg.Add(1)
+		go func(c *Client) {
+			defer wg.Done()
+			c.drain(deadline)
+			c.Close(closeGoingAway, reason)
+		}(c)
+	}
+	wg.Wait()
+
+	h.Clear()
+}
+
+// Config returns the configuration currently in use by the hub.
+func (h *Hub) Config() *Config {
+	h.Lock()
+	defer h.Unlock()
+	return h.config
+}
+
+// SetConfig sets the configuration used for new clients.
+func (h *Hub) SetConfig(cfg *Config) {
+	h.Lock()
+	h.config = cfg
+	h.Unlock()
+	aggregates.Apply(cfg)
+}
+
+// ApplyConfig replaces the configuration of the hub and applies it to the connected clients: policies and bandwidth
+// limits are updated, clients are re-authorized according to the new authorization settings and clients which were moved
+// to another virtual network or whose MAC address is no longer accepted are disconnected. A report of the changes is returned.
+func (h *Hub) ApplyConfig(cfg *Config) []string {
+	var disconnect []*Client
+	var reasons []string
+	h.Lock()
+	old := h.config
+	h.config = cfg
+	report := cfg.diff(old)
+	aggregates.Apply(cfg)
+
+	for _, c := range h.clients {
+		c.mu.Lock()
+		oldPolicy, wasAuthorized, mac := c.policy, c.authorized, c.mac
+		c.mu.Unlock()
+
+		policy, authorized := cfg.reauthorize(oldPolicy, wasAuthorized)
+		c.setPolicy(policy, authorized)
+
+		if wasAuthorized != authorized {
+			if authorized {
+				report = append(report, fmt.Sprintf("client %v: authorized", c))
+			} else {
+				report = append(report, fmt.Sprintf("client %v: authorization revoked", c))
+				if err := c.sendChallenge(); err != nil {
+					logAuth.Error("challenge_failed", c, "sending authorization challenge: %v", err)
+				}
+			}
+		}
+
+		var reason string
+		switch {
+		case policy.VLAN != oldPolicy.VLAN:
+			reason = "virtual network changed"
+		case mac != nil && policy.MACPrefix != "" && !strings.HasPrefix(mac.String(), policy.MACPrefix):
+			reason = "MAC address no longer accepted"
+		default:
+			continue
+		}
+		report = append(report, fmt.Sprintf("client %v: disconnected because %s", c, reason))
+		disconnect = append(disconnect, c)
+		reasons = append(reasons, reason)
+	}
+	h.Unlock()
+
+	for i, c := range disconnect {
+		c.Close(closePolicyViolation, reasons[i])
+		h.Remove(c)
+	}
+
+	return report
+}
+
+// Authorize authorizes the client with the specified policy, unless the policy expired or its identity
+// already has the maximum number of sessions.
+func (h *Hub) Authorize(c *Client, p *Policy) error {
+	if p.Expired(time.Now()) {
+		return errKeyExpired
+	}
+	if quotaAction == "disconnect" && quotas.Exceeded(p.Identity, p.quota) {
+		return errQuotaExceeded
+	}
+
+	var evicted *Client
+	h.Lock()
+	if max := p.maxSessions(); max != 0 {
+		sessions := h.sessions(p.Identity)
+		if len(sessions) >= max {
+			if !evictOldestSession {
+				h.Unlock()
+				return errTooManySessions
+			}
+			evicted = sessions[0]
+		}
+	}
+	c.setPolicy(p, true)
+	h.Unlock()
+
+	if evicted != nil {
+		logConn.Info("session_replaced", evicted, "replaced by a new session of the same identity")
+		evicted.Close(closePolicyViolation, "session replaced")
+		h.Remove(evicted)
+	}
+	return nil
+}
+
+// canStartSession returns true if the identity of the policy has not yet reached its maximum number of sessions,
+// or the oldest session would be evicted.
+func (h *Hub) canStartSession(p *Policy) bool {
+	max := p.maxSessions()
+	if max == 0 || evictOldestSession {
+		return true
+	}
+	h.Lock()
+	defer h.Unlock()
+	return len(h.sessions(p.Identity)) < max
+}
+
+// sessions returns the clients authorized with the specified identity, oldest first; hub must be locked by the caller.
+func (h *Hub) sessions(identity string) []*Client {
+	var sessions []*Client
+	for _, c := range h.clients {
+		c.mu.Lock()
+		if c.authorized && c.policy.Identity == identity {
+			sessions = append(sessions, c)
+		}
+		c.mu.Unlock()
+	}
+	sort.Slice(sessions, func(i, j int) bool { return sessions[i].id < sessions[j].id })
+	return sessions
+}
+
+// Sessions returns the clients authorized with the specified identity.
+func (h *Hub) Sessions(identity string) []*Client {
+	h.Lock()
+	defer h.Unlock()
+	return h.sessions(identity)
+}
+
+// checkConnectionLimits returns an error if a new client from the remote address would exceed the max number of clients,
+// globally or from the address; hub must be locked by the caller.
+func (h *Hub) checkConnectionLimits(remoteAddress string) error {
+	if maxClients != 0 && len(h.clients) >= maxClients {
+		return errTooManyClients
+	}
+	if maxClientsPerAddress != 0 {
+		key := addressKey(remoteAddress)
+		var n int
+		for _, c := range h.clients {
+			if addressKey(c.remoteAddress) == key {
+				n++
+			}
+		}
+		if n >= maxClientsPerAddress {
+			return errTooManyClientsFromAddress
+		}
+	}
+	return nil
+}
+
+// DisconnectAddress closes the connections of the clients from the remote address, or from its subnet as grouped for
+// bans and connection limits; it returns the number of disconnected clients.
+func (h *Hub) DisconnectAddress(address string, code int, reason string) int {
+	key := addressKey(address)
+	var disconnect []*Client
+	h.Lock()
+	for _, c := range h.clients {
+		if addressKey(c.remoteAddress) == key {
+			disconnect = append(disconnect, c)
+		}
+	}
+	h.Unlock()
+
+	for _, c := range disconnect {
+		c.Close(code, reason)
+		h.Remove(c)
+	}
+	return len(disconnect)
+}
+
+// CheckConnectionLimits returns an error if a new client from the remote address would exceed the connection limits.
+func (h *Hub) CheckConnectionLimits(remoteAddress string) error {
+	h.Lock()
+	defer h.Unlock()
+	return h.checkConnectionLimits(remoteAddress)
+}
+
 // NewHub returns an initialized hub.
 func NewHub() *Hub {
-	h := &Hub{}
+	h := &Hub{config: &Config{}}
 	h.clients = map[*websocket.Conn]*Client{}
 	h.clientsByMAC = map[string]*Client{}
 	return h
 }
 
-// HandleSpecialFrame handles a special frame; currently only AUTH is supported, PING could be added here.
+// HandleSpecialFrame handles a special frame; currently only AUTH, HMAC, XOFF and XON are supported, PING could be added here.
 func (c *Client) HandleSpecialFrame(payload []byte) (skipFrame, flagAsBad bool, e error) {
+	if fields := strings.Fields(string(payload)); len(fields) != 0 && (fields[0] == "XOFF" || fields[0] == "XON") {
+		skipFrame = true
+		e = c.handleFlowControl(fields)
+		return
+	}
 	if len(payload) < 8 {
 		skipFrame = true
 		e = fmt.Errorf("too short special frame payload (%d bytes)", len(payload))
@@ -178,29 +703,53 @@ func (c *Client) HandleSpecialFrame(payload []byte) (skipFrame, flagAsBad bool,
 	prefix := string(payload[:5])
 	switch prefix {
 	case "AUTH ":
-		DebugPrintf("received auth frame: %q", string(payload))
-		if authKey == "" {
+		// the key itself is never logged
+		logAuth.Debug("auth_frame", c, "received AUTH frame (%d bytes)", len(payload))
+		skipFrame = true
+		cfg := c.hub.Config()
+		if !cfg.authRequired() {
 			e = errors.New("ignoring AUTH frame (authorization disabled on server side)")
-			skipFrame = true
 			return
 		}
-		if c.authorized {
-			skipFrame = true
+		if c.isAuthorized() {
 			e = errors.New("client already authorized, ignoring AUTH")
 			return
 		}
-		key := string(payload[5:])
-		if key == authKey {
-			c.authorized = true
-			InfoPrintf("AUTH key accepted")
-			skipFrame = true
+		credential := string(payload[5:])
+		if cfg.TokenSecret != "" && isToken(credential) {
+			// access tokens are short-lived, thus accepted in clear
+			flagAsBad, e = c.authorizeToken(credential)
 			return
 		}
-		// failure to authorize
-		e = errors.New("AUTH key not accepted")
+		if !allowPlainAuth {
+			// the webhook too verifies credentials sent in clear
+			e = errPlainAuthDisabled
+			return
+		}
+		if cfg.AuthWebhook != "" && cfg.lookupKey(credential) == nil {
+			flagAsBad, e = c.authorizeWebhook(credential)
+			return
+		}
+		flagAsBad, e = c.authorize(cfg.lookupKey(credential))
+		return
+	case "HMAC ":
+		logAuth.Debug("hmac_frame", c, "received HMAC frame (%d bytes)", len(payload))
 		skipFrame = true
-		// do not close the connection but put it in an idle loop
-		flagAsBad = true
+		cfg := c.hub.Config()
+		if !cfg.authRequired() {
+			e = errors.New("ignoring HMAC frame (authorization disabled on server side)")
+			return
+		}
+		if c.isAuthorized() {
+			e = errors.New("client already authorized, ignoring HMAC")
+			return
+		}
+		nonce := c.takeNonce()
+		if nonce == nil {
+			e = errors.New("no challenge pending, ignoring HMAC")
+			return
+		}
+		flagAsBad, e = c.authorize(cfg.verifyResponse(nonce, string(payload[5:])))
 		return
 	}
 	e = errors.New("invalid special frame: " + prefix)
@@ -208,6 +757,21 @@ func (c *Client) HandleSpecialFrame(payload []byte) (skipFrame, flagAsBad bool,
 	return
 }
 
+// authorize authorizes the client with the policy of the key it presented, or nil if the key was not accepted;
+// it returns true if the client should be put in the idle loop.
+func (c *Client) authorize(policy *Policy) (bool, error) {
+	if policy == nil {
+		// failure to authorize; do not close the connection but put it in an idle loop
+		return true, errors.New("AUTH key not accepted")
+	}
+	if err := c.hub.Authorize(c, policy); err != nil {
+		// an expired key is as bad as a wrong one, while the sessions limit is temporary
+		return err == errKeyExpired, err
+	}
+	logAuth.Info("client_authorized", c, "AUTH key accepted")
+	return false, nil
+}
+
 // CanSourceMac returns true if the client is misbehaving and should be blocked, and an error if client is not allowed to source frames from the specified MAC address.
 func (h *Hub) CanSourceMAC(c *Client, mac net.HardwareAddr) (bool, error) {
 	h.Lock()
@@ -226,14 +790,23 @@ func (h *Hub) CanSourceMAC(c *Client, mac net.HardwareAddr) (bool, error) {
 		}
 
 		// if MAC prefix whitelisting is enabled, validate against it
-		if macPrefix != "" && !strings.HasPrefix(src, macPrefix) {
+		policy := c.Policy()
+		if policy.MACPrefix != "" && !strings.HasPrefix(src, policy.MACPrefix) {
 			h.Unlock()
 			return true, errors.New("MAC address will not be accepted")
 		}
 
+		// MAC addresses reserved to an identity cannot be used by other clients
+		if owner, ok := h.config.reservedMACs[src]; ok && owner != policy.Identity {
+			h.Unlock()
+			return true, errors.New("MAC address is reserved")
+		}
+
+		c.mu.Lock()
 		c.mac = mac
+		c.mu.Unlock()
 		h.clientsByMAC[src] = c
-		InfoPrintf("client %v: now associated with MAC %s", c, src)
+		logSwitch.Info("mac_associated", c, "now associated with MAC %s", src)
 		h.Unlock()
 		return false, nil
 	}
@@ -249,54 +822,192 @@ func (h *Hub) CanSourceMAC(c *Client, mac net.HardwareAddr) (bool, error) {
 	return false, nil
 }
 
-// SwitchFrame switches a frame to either broadcast addresses or local websocket clients; returns true if frame was handled and an error in case of delivery errors.
+// SwitchFrame switches a frame to either broadcast addresses or local websocket clients of the same VLAN; returns true if frame was handled.
+// Frames for the TAP interface are queued, thus errors writing them are reported by the uplink queue.
 // based on https://github.com/benjamincburns/websockproxy/blob/master/switchedrelay.py
-func (h *Hub) SwitchFrame(source RateLimiter, frame []byte) (bool, error) {
+func (h *Hub) SwitchFrame(source RateLimiter, vlan int, frame []byte) bool {
 	h.Lock()
 	defer h.Unlock()
 
 	dst := waterutil.MACDestination(frame)
-	if waterutil.IsBroadcast(dst) && waterutil.IsIPv4Multicast(dst) {
-		// broadcast message to all known peers
+	class := classifyFrame(frame)
+	if isGroupAddress(frame) {
+		// broadcast message to all known peers, except the source
 		for _, peer := range h.clientsByMAC {
-			peer.Download(frame)
+			if peer != source && peer.Policy().VLAN == vlan {
+				h.deliver(peer, frame, class)
+			}
 		}
 		if source != nil {
 			// finally broadcast on TAP interface itself
-			if source.UploadThrottle(len(frame)) {
-				WarningPrintf("client %v, frame %v: discarding because of upload rate limiting", source, frame)
-			} else {
-				_, err := tap.Write(frame)
-				if err != nil {
-					return false, err
-				}
-			}
+			h.uplink(source, vlan, frame)
 		}
-		return true, nil
+		return true
 	}
 
 	// send to a specific peer
-	if peer, ok := h.clientsByMAC[dst.String()]; ok {
-		peer.Download(frame)
-		return true, nil
+	if peer, ok := h.clientsByMAC[dst.String()]; ok && peer.Policy().VLAN == vlan {
+		h.deliver(peer, frame, class)
+		return true
 	}
 	if source != nil {
 		// send on TAP interface itself
-		if source.UploadThrottle(len(frame)) {
-			WarningPrintf("client %v, frame %v: discarding because of upload rate limiting", source, frame)
-		} else {
-			_, err := tap.Write(frame)
-			if err != nil {
-				return false, err
+		h.uplink(source, vlan, frame)
+		return true
+	}
+	return false
+}
+
+// uplink queues a frame of a client for the TAP interface; upload limits were already applied by LimitUpload. Hub must
+// be locked by the caller.
+func (h *Hub) uplink(source RateLimiter, vlan int, frame []byte) {
+	c, _ := source.(*Client)
+	if c != nil && h.clients[c.ws] != c {
+		// the client was removed meanwhile, e.g. while its frame was delayed: queueing would re-create its uplink queue
+		return
+	}
+	if !uplink.Enqueue(source, vlan, frame) {
+		logSwitch.Warning("uplink_queue_drop", c, "frame %v: discarding because the uplink queue is full", Frame(frame))
+	}
+}
+
+// deliver queues a frame for a client after applying the impairment of its link; hub must be locked by the caller.
+func (h *Hub) deliver(c *Client, frame []byte, class priorityClass) {
+	copies, delay := impairments.Impair(c, impairDownload, frame)
+	for i := 0; i < copies; i++ {
+		if delay == 0 {
+			c.Download(frame, class)
+			continue
+		}
+		time.AfterFunc(delay, func() {
+			h.Lock()
+			// the client might have disconnected in the meantime
+			if h.clients[c.ws] == c {
+				c.Download(frame, class)
+			}
+			h.Unlock()
+		})
+	}
+}
+
+// writeTAP writes a frame on the TAP interface, tagged with its VLAN unless it belongs to the default network.
+func writeTAP(vlan int, frame []byte) error {
+	if vlan != 0 {
+		frame = tagFrame(frame, vlan)
+	}
+	_, err := tap.Write(frame)
+	return err
+}
+
+// isDegraded returns true if only control traffic is delivered to the client; the degradation ends
+// once its queue is no longer saturated.
+func (c *Client) isDegraded() bool {
+	c.mu.Lock()
+	recovered := c.degraded && c.frames.SaturatedFor(time.Now()) == 0
+	if recovered {
+		c.degraded = false
+	}
+	degraded := c.degraded
+	c.mu.Unlock()
+
+	if recovered {
+		logSwitch.Info("slow_consumer_recovered", c, "no longer a slow consumer, delivering all traffic")
+	}
+	return degraded
+}
+
+// checkSlowConsumer evicts or degrades the client if its queue has been saturated for longer than allowed.
+func (c *Client) checkSlowConsumer() {
+	// a client which paused the delivery is not reading on purpose
+	if slowConsumerTimeout == 0 || c.isPaused() || c.frames.SaturatedFor(time.Now()) < slowConsumerTimeout {
+		return
+	}
+
+	switch slowConsumerAction {
+	case "degrade":
+		c.mu.Lock()
+		wasDegraded := c.degraded
+		c.degraded = true
+		c.mu.Unlock()
+		if !wasDegraded {
+			atomic.AddUint64(&stats.SlowConsumerDegradations, 1)
+			logSwitch.Warning("slow_consumer_degraded", c, "slow consumer, delivering only control traffic")
+		}
+	case "evict":
+		if c.isTerminated() {
+			return
+		}
+		// terminate immediately so that eviction happens only once, but do not block the caller on network writes
+		c.terminate()
+		atomic.AddUint64(&stats.SlowConsumerEvictions, 1)
+		logSwitch.Warning("slow_consumer_evicted", c, "evicting slow consumer")
+		go func() {
+			c.Close(closePolicyViolation, "slow consumer")
+			c.hub.Remove(c)
+		}()
+	}
+}
+
+// MAC returns the MAC address associated with the client, if any.
+func (c *Client) MAC() net.HardwareAddr {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.mac
+}
+
+// admitFrame returns true if a frame of the specified size can be queued for the client without exceeding the memory budget
+// of the hub. When the budget is exhausted, clients holding more than a fair share of it have their frames refused, while
+// for the other clients room is made by dropping the lowest priority frames of the clients holding the most buffered data.
+// Hub must be locked by the caller.
+func (h *Hub) admitFrame(c *Client, size int) bool {
+	limit := h.config.MaxQueuedBytes
+	if limit == 0 || atomic.LoadInt64(&h.queuedBytes)+int64(size) <= limit {
+		return true
+	}
+
+	fairShare := limit / int64(len(h.clients))
+	if c.frames.Bytes()+int64(size) > fairShare {
+		return false
+	}
+
+	for atomic.LoadInt64(&h.queuedBytes)+int64(size) > limit {
+		var heaviest *Client
+		var heaviestBytes int64
+		for _, peer := range h.clients {
+			if b := peer.frames.Bytes(); b > heaviestBytes {
+				heaviest, heaviestBytes = peer, b
 			}
 		}
-		return true, nil
+		if heaviest == nil || heaviestBytes <= fairShare {
+			return false
+		}
+		if heaviest.frames.DropOldest() == 0 {
+			return false
+		}
+		atomic.AddUint64(&stats.MemoryBudgetReclaims, 1)
+		logSwitch.Debug("memory_budget_reclaim", heaviest, "dropped queued frame to make room for client %d", c.id)
 	}
-	return false, nil
+	return true
 }
 
-// Download queues a frame for receipt into the websocket stream of a specific client; the call is non-blocking.
-func (c *Client) Download(frame []byte) {
-	go func() { c.frameReceiver <- frame }()
-	DebugPrintf("client %v, frame %v: queued for receipt", c, frame)
+// Download queues a frame for receipt into the websocket stream of a specific client; the call is non-blocking
+// and the frame is dropped when the queue of its priority class is full.
+func (c *Client) Download(frame []byte, class priorityClass) {
+	if c.isDegraded() && class != priorityControl {
+		atomic.AddUint64(&stats.DegradedDrops, 1)
+		logSwitch.Debug("degraded_drop", c, "frame %v: discarding %s frame of slow consumer", Frame(frame), class)
+		return
+	}
+	if !c.hub.admitFrame(c, len(frame)) {
+		atomic.AddUint64(&stats.MemoryBudgetDrops, 1)
+		logSwitch.Warning("memory_budget_drop", c, "frame %v: discarding because the memory budget for queued frames is exhausted", Frame(frame))
+		return
+	}
+	if !c.frames.Push(class, frame) {
+		atomic.AddUint64(&stats.QueueOverflows, 1)
+		logSwitch.Warning("queue_overflow_drop", c, "frame %v: discarding because %s queue is full", Frame(frame), class)
+		c.checkSlowConsumer()
+		return
+	}
+	logSwitch.Debug("frame_queued", c, "frame %v: queued for receipt", Frame(frame))
 }
@@ -0,0 +1,286 @@
+/* go-websockproxy - https://github.com/gdm85/go-websockproxy
+Copyright (C) 2016 gdm85
+
+This program is free software; you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation; either version 2 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License along
+with this program; if not, write to the Free Software Foundation, Inc.,
+51 Franklin Street, Fifth Floor, Boston, MA 02110-1301 USA.
+*/
+package main
+
+import (
+	"errors"
+	"fmt"
+	"math/rand"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// maxImpairmentBacklog is the longest a frame can wait behind the frames already serialized at the emulated rate
+// of a link; frames which would wait longer are dropped, like in a full router buffer.
+const maxImpairmentBacklog = time.Second
+
+// impairment directions, relative to the client
+const (
+	impairUpload = iota
+	impairDownload
+)
+
+// Impairment describes the emulated defects of a network link.
+type Impairment struct {
+	Latency time.Duration
+	// Jitter is the maximum random variation of the latency, in either direction
+	Jitter time.Duration
+	// percentages of the frames which are lost, duplicated or sent ahead of the delayed frames
+	Loss, Duplicate, Reorder float64
+	// Rate is the emulated link rate in bytes per second, 0 for an unlimited rate
+	Rate int64
+	// Seed initializes the random source of the link, so that impairments can be reproduced
+	Seed int64
+}
+
+// String returns a human-readable description of the impairment.
+func (imp Impairment) String() string {
+	s := fmt.Sprintf("latency=%v jitter=%v loss=%g%% duplicate=%g%% reorder=%g%%", imp.Latency, imp.Jitter, imp.Loss, imp.Duplicate, imp.Reorder)
+	if imp.Rate != 0 {
+		s += fmt.Sprintf(" rate=%d bytes/s", imp.Rate)
+	}
+	return s + fmt.Sprintf(" seed=%d", imp.Seed)
+}
+
+// parseImpairment parses an impairment from the 'latency', 'jitter', 'loss', 'duplicate', 'reorder', 'rate' and 'seed'
+// parameters; parameters which are not specified are not impaired, except for the seed which defaults to the
+// seed specified via command-line option.
+func parseImpairment(values url.Values) (Impairment, error) {
+	imp := Impairment{Seed: impairmentSeed}
+	var err error
+	for _, d := range []struct {
+		name  string
+		value *time.Duration
+	}{{"latency", &imp.Latency}, {"jitter", &imp.Jitter}} {
+		if s := values.Get(d.name); s != "" {
+			*d.value, err = time.ParseDuration(s)
+			if err != nil {
+				return imp, fmt.Errorf("invalid %s: %v", d.name, err)
+			}
+			if *d.value < 0 {
+				return imp, fmt.Errorf("invalid %s: must not be negative", d.name)
+			}
+		}
+	}
+	for _, p := range []struct {
+		name  string
+		value *float64
+	}{{"loss", &imp.Loss}, {"duplicate", &imp.Duplicate}, {"reorder", &imp.Reorder}} {
+		if s := values.Get(p.name); s != "" {
+			*p.value, err = strconv.ParseFloat(strings.TrimSuffix(s, "%"), 64)
+			if err != nil {
+				return imp, fmt.Errorf("invalid %s: %v", p.name, err)
+			}
+			if *p.value < 0 || *p.value > 100 {
+				return imp, fmt.Errorf("invalid %s: must be a percentage between 0 and 100", p.name)
+			}
+		}
+	}
+	if s := values.Get("rate"); s != "" {
+		imp.Rate, err = parseQuantity(s, rateUnits)
+		if err != nil {
+			return imp, fmt.Errorf("invalid rate: %v", err)
+		}
+	}
+	if s := values.Get("seed"); s != "" {
+		imp.Seed, err = strconv.ParseInt(s, 10, 64)
+		if err != nil {
+			return imp, fmt.Errorf("invalid seed: %v", err)
+		}
+	}
+	if imp == (Impairment{Seed: imp.Seed}) {
+		return imp, errors.New("no impairment specified")
+	}
+	return imp, nil
+}
+
+// impairedDirection is the state of one direction of an impaired link.
+type impairedDirection struct {
+	rnd *rand.Rand
+	// busyUntil is when the last frame serialized at the emulated rate leaves the link
+	busyUntil time.Time
+}
+
+// impairedLink is an impaired link; each direction has its own random source, so that the outcome of the traffic in one
+// direction does not depend on the traffic in the other.
+type impairedLink struct {
+	Impairment
+	directions [2]impairedDirection
+}
+
+// newImpairedLink returns a link with the specified impairment.
+func newImpairedLink(imp Impairment) *impairedLink {
+	l := &impairedLink{Impairment: imp}
+	for i := range l.directions {
+		l.directions[i].rnd = rand.New(rand.NewSource(imp.Seed + int64(i)))
+	}
+	return l
+}
+
+// chance returns true with the specified percent probability.
+func (d *impairedDirection) chance(percent float64) bool {
+	return percent > 0 && d.rnd.Float64()*100 < percent
+}
+
+// impair returns how many copies of a frame of the specified size are delivered in the direction, 0 if the frame is lost,
+// and after how long.
+func (l *impairedLink) impair(direction, size int, now time.Time) (int, time.Duration) {
+	d := &l.directions[direction]
+	if d.chance(l.Loss) {
+		return 0, 0
+	}
+	copies := 1
+	if d.chance(l.Duplicate) {
+		copies = 2
+	}
+
+	var delay time.Duration
+	// reordered frames are not delayed, thus they overtake the frames still in flight
+	if !d.chance(l.Reorder) {
+		delay = l.Latency
+		if l.Jitter != 0 {
+			delay += time.Duration((d.rnd.Float64()*2 - 1) * float64(l.Jitter))
+		}
+		if delay < 0 {
+			delay = 0
+		}
+	}
+
+	if l.Rate != 0 {
+		if d.busyUntil.Before(now) {
+			d.busyUntil = now
+		}
+		if d.busyUntil.Sub(now) > maxImpairmentBacklog {
+			return 0, 0
+		}
+		d.busyUntil = d.busyUntil.Add(time.Duration(float64(size) / float64(l.Rate) * float64(time.Second)))
+		delay += d.busyUntil.Sub(now)
+	}
+	return copies, delay
+}
+
+// Impairments holds the impairments of the links of single clients and of whole networks; the impairment of a client
+// takes precedence over the impairment of its network.
+type Impairments struct {
+	sync.Mutex
+	clients  map[uint64]*impairedLink
+	networks map[int]*impairedLink
+}
+
+var impairments = NewImpairments()
+
+// NewImpairments returns an empty set of impairments.
+func NewImpairments() *Impairments {
+	return &Impairments{
+		clients:  map[uint64]*impairedLink{},
+		networks: map[int]*impairedLink{},
+	}
+}
+
+// SetClient impairs the link of a client; the random source is reset, so that the same traffic is impaired the same way.
+func (im *Impairments) SetClient(id uint64, imp Impairment) {
+	im.Lock()
+	im.clients[id] = newImpairedLink(imp)
+	im.Unlock()
+	logLimit.Info("client_impaired", nil, "link of client %d impaired with %v", id, imp)
+}
+
+// SetNetwork impairs the links of all clients of a network which are not impaired individually.
+func (im *Impairments) SetNetwork(vlan int, imp Impairment) {
+	im.Lock()
+	im.networks[vlan] = newImpairedLink(imp)
+	im.Unlock()
+	logLimit.Info("network_impaired", nil, "links of network %d impaired with %v", vlan, imp)
+}
+
+// ClearClient removes the impairment of the link of a client; it returns false if the link was not impaired.
+func (im *Impairments) ClearClient(id uint64) bool {
+	im.Lock()
+	defer im.Unlock()
+	if _, ok := im.clients[id]; !ok {
+		return false
+	}
+	delete(im.clients, id)
+	logLimit.Info("client_impairment_cleared", nil, "link of client %d no longer impaired", id)
+	return true
+}
+
+// ClearNetwork removes the impairment of the links of a network; it returns false if the network was not impaired.
+func (im *Impairments) ClearNetwork(vlan int) bool {
+	im.Lock()
+	defer im.Unlock()
+	if _, ok := im.networks[vlan]; !ok {
+		return false
+	}
+	delete(im.networks, vlan)
+	logLimit.Info("network_impairment_cleared", nil, "links of network %d no longer impaired", vlan)
+	return true
+}
+
+// List returns a description of all impairments, one per line, networks first.
+func (im *Impairments) List() []string {
+	im.Lock()
+	defer im.Unlock()
+	var lines []string
+	vlans := make([]int, 0, len(im.networks))
+	for vlan := range im.networks {
+		vlans = append(vlans, vlan)
+	}
+	sort.Ints(vlans)
+	for _, vlan := range vlans {
+		lines = append(lines, fmt.Sprintf("network %d %v", vlan, im.networks[vlan].Impairment))
+	}
+	ids := make([]uint64, 0, len(im.clients))
+	for id := range im.clients {
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+	for _, id := range ids {
+		lines = append(lines, fmt.Sprintf("client %d %v", id, im.clients[id].Impairment))
+	}
+	return lines
+}
+
+// Impair returns how many copies of a frame sent in the direction over the link of the client are delivered,
+// 0 if the frame is lost, and after how long.
+func (im *Impairments) Impair(c *Client, direction int, frame []byte) (int, time.Duration) {
+	vlan := c.Policy().VLAN
+	im.Lock()
+	defer im.Unlock()
+	l, ok := im.clients[c.id]
+	if !ok {
+		l, ok = im.networks[vlan]
+		if !ok {
+			return 1, 0
+		}
+	}
+	copies, delay := l.impair(direction, len(frame), time.Now())
+	switch copies {
+	case 0:
+		atomic.AddUint64(&stats.ImpairmentDrops, 1)
+		logLimit.Debug("impairment_drop", c, "frame %v: lost because of link impairment", Frame(frame))
+	case 2:
+		atomic.AddUint64(&stats.ImpairmentDuplicates, 1)
+	}
+	return copies, delay
+}
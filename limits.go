@@ -0,0 +1,316 @@
+/* go-websockproxy - https://github.com/gdm85/go-websockproxy
+Copyright (C) 2016 gdm85
+
+This program is free software; you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation; either version 2 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License along
+with this program; if not, write to the Free Software Foundation, Inc.,
+51 Franklin Street, Fifth Floor, Boston, MA 02110-1301 USA.
+*/
+package main
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	// time after its last frame a member of a group is no longer considered active for fair sharing
+	shareActivityWindow = time.Second
+	// interval between the sweeps of the idle groups of identities and networks
+	aggregateSweepInterval = time.Minute
+)
+
+// limiter is one of the levels of bandwidth limits a frame is subject to.
+type limiter interface {
+	// delay returns the time after which a payload of the specified size conforms to the limit, 0 if it does now
+	delay(size int) time.Duration
+	// consume accounts for a payload of the specified size
+	consume(size int)
+}
+
+// throttle returns true if a payload exceeds any of the limits; otherwise it is accounted for at all of them.
+func throttle(size int, limits []limiter) bool {
+	for _, l := range limits {
+		if l.delay(size) > 0 {
+			return true
+		}
+	}
+	for _, l := range limits {
+		l.consume(size)
+	}
+	return false
+}
+
+// wait returns the delay after which a payload conforms to all limits, without accounting for it.
+func wait(size int, limits []limiter) time.Duration {
+	var delay time.Duration
+	for _, l := range limits {
+		if d := l.delay(size); d > delay {
+			delay = d
+		}
+	}
+	return delay
+}
+
+// reserve accounts for a payload at all limits and returns the delay after which it conforms to all of them; if the
+// delay would exceed maxDelay nothing is accounted and false is returned, meaning that the payload should be dropped.
+func reserve(size int, maxDelay time.Duration, limits []limiter) (time.Duration, bool) {
+	delay := wait(size, limits)
+	if delay > maxDelay {
+		return 0, false
+	}
+	for _, l := range limits {
+		l.consume(size)
+	}
+	return delay, true
+}
+
+// memberShare is the fair share of the budget of a group used by one of its members.
+type memberShare struct {
+	tokens                float64
+	lastCheck, lastActive time.Time
+}
+
+// aggregateLimit is a bandwidth limit shared by a group: the clients of an identity, the identities of a network or
+// the networks of the whole proxy. The budget is shared fairly among the active members of the group, which can
+// however use the spare budget as long as the bucket of the group is at least half full.
+type aggregateLimit struct {
+	bucket BandwidthAllowance
+
+	mu        sync.Mutex
+	members   map[string]*memberShare
+	active    int
+	lastCount time.Time
+}
+
+// newAggregateLimit returns a group limit with the specified bandwidth.
+func newAggregateLimit(bw Bandwidth) *aggregateLimit {
+	al := &aggregateLimit{members: map[string]*memberShare{}}
+	al.bucket.SetRate(bw)
+	return al
+}
+
+// share returns the share of a member, counting the active members at most every tenth of the activity window;
+// aggregate limit must be locked by the caller.
+func (al *aggregateLimit) share(member string, now time.Time) *memberShare {
+	s, ok := al.members[member]
+	if !ok {
+		s = &memberShare{tokens: math.Inf(1), lastCheck: now, lastActive: now}
+		al.members[member] = s
+		al.active++
+	}
+	if now.Sub(al.lastCount) > shareActivityWindow/10 {
+		al.active = 0
+		for key, m := range al.members {
+			if now.Sub(m.lastActive) > shareActivityWindow {
+				delete(al.members, key)
+				continue
+			}
+			al.active++
+		}
+		al.lastCount = now
+	}
+	return s
+}
+
+// idle returns true if the group has no active member and its bucket is full, so that it can be forgotten without
+// any effect on the limit.
+func (al *aggregateLimit) idle() bool {
+	now := al.bucket.now()
+	al.mu.Lock()
+	for key, m := range al.members {
+		if now.Sub(m.lastActive) > shareActivityWindow {
+			delete(al.members, key)
+		}
+	}
+	active := len(al.members)
+	al.mu.Unlock()
+	return active == 0 && al.bucket.full()
+}
+
+// memberDelay returns the time after which a payload of a member conforms to its fair share of the budget.
+func (al *aggregateLimit) memberDelay(member string, size int) time.Duration {
+	rate, burst := al.bucket.limits()
+	if rate == 0 {
+		return 0
+	}
+	now := al.bucket.now()
+
+	al.mu.Lock()
+	defer al.mu.Unlock()
+	s := al.share(member, now)
+	n := float64(al.active)
+	if n < 1 {
+		n = 1
+	}
+	shareRate, shareBurst := rate/n, burst/n
+	s.tokens = math.Min(s.tokens+now.Sub(s.lastCheck).Seconds()*shareRate, shareBurst)
+	s.lastCheck = now
+	missing := math.Min(float64(size), shareBurst) - s.tokens
+	if missing <= 0 {
+		return 0
+	}
+	return time.Duration(missing / shareRate * float64(time.Second))
+}
+
+// memberConsume accounts for a payload of a member; the debt of a member which used the spare budget is bounded by its
+// share of the burst, so that it is not starved afterwards.
+func (al *aggregateLimit) memberConsume(member string, size int) {
+	al.bucket.consume(size)
+	_, burst := al.bucket.limits()
+	now := al.bucket.now()
+
+	al.mu.Lock()
+	s := al.share(member, now)
+	s.tokens = math.Max(s.tokens-float64(size), -burst/math.Max(float64(al.active), 1))
+	s.lastActive = now
+	al.mu.Unlock()
+}
+
+// memberLimit is the limit of a group as seen by one of its members.
+type memberLimit struct {
+	group  *aggregateLimit
+	member string
+}
+
+// delay returns the time after which a payload conforms to the limit of the group and, unless the group has spare
+// budget, to the fair share of the member.
+func (ml memberLimit) delay(size int) time.Duration {
+	delay := ml.group.bucket.delay(size)
+	if ml.group.bucket.spare() {
+		return delay
+	}
+	if d := ml.group.memberDelay(ml.member, size); d > delay {
+		delay = d
+	}
+	return delay
+}
+
+// consume accounts for a payload at the group and at the share of the member.
+func (ml memberLimit) consume(size int) {
+	ml.group.memberConsume(ml.member, size)
+}
+
+// directionLimits are the group limits of one direction of traffic.
+type directionLimits struct {
+	identity, network, total Bandwidth
+	identities               map[string]*aggregateLimit
+	networks                 map[int]*aggregateLimit
+	global                   *aggregateLimit
+	lastSweep                time.Time
+}
+
+// AggregateLimits holds the bandwidth limits of the groups of clients: per identity, per virtual network and for the
+// whole proxy. Limits of groups apply in addition to the limits of each client, except for control traffic.
+type AggregateLimits struct {
+	sync.Mutex
+	upload, download directionLimits
+}
+
+var aggregates = &AggregateLimits{
+	upload:   directionLimits{identities: map[string]*aggregateLimit{}, networks: map[int]*aggregateLimit{}},
+	download: directionLimits{identities: map[string]*aggregateLimit{}, networks: map[int]*aggregateLimit{}},
+}
+
+// Apply sets the group bandwidths of the configuration; limits of existing groups are updated.
+func (al *AggregateLimits) Apply(cfg *Config) {
+	al.Lock()
+	defer al.Unlock()
+	al.upload.apply(cfg.identityUploadBandwidth, cfg.networkUploadBandwidth, cfg.totalUploadBandwidth)
+	al.download.apply(cfg.identityDownloadBandwidth, cfg.networkDownloadBandwidth, cfg.totalDownloadBandwidth)
+}
+
+// apply sets the bandwidths of the groups; aggregate limits must be locked by the caller.
+func (dl *directionLimits) apply(identity, network, total Bandwidth) {
+	dl.identity, dl.network, dl.total = identity, network, total
+	for _, l := range dl.identities {
+		l.bucket.SetRate(identity)
+	}
+	for _, l := range dl.networks {
+		l.bucket.SetRate(network)
+	}
+	if dl.global == nil {
+		dl.global = newAggregateLimit(total)
+	} else {
+		dl.global.bucket.SetRate(total)
+	}
+}
+
+// sweep forgets the idle groups of identities and networks, which would otherwise accumulate as clients come and go;
+// aggregate limits must be locked by the caller.
+func (dl *directionLimits) sweep() {
+	now := time.Now()
+	if now.Sub(dl.lastSweep) < aggregateSweepInterval {
+		return
+	}
+	dl.lastSweep = now
+	for identity, l := range dl.identities {
+		if l.idle() {
+			delete(dl.identities, identity)
+		}
+	}
+	for vlan, l := range dl.networks {
+		if l.idle() {
+			delete(dl.networks, vlan)
+		}
+	}
+}
+
+// limits returns the group limits applying to a client with the specified policy; aggregate limits must be locked by the caller.
+func (dl *directionLimits) limits(c *Client, p *Policy) []limiter {
+	dl.sweep()
+	var limits []limiter
+	client := strconv.FormatUint(c.id, 10)
+	member := "client " + client
+	if p.Identity != "" && !dl.identity.Unlimited() {
+		l, ok := dl.identities[p.Identity]
+		if !ok {
+			l = newAggregateLimit(dl.identity)
+			dl.identities[p.Identity] = l
+		}
+		limits = append(limits, memberLimit{l, client})
+	}
+	if p.Identity != "" {
+		member = "identity " + p.Identity
+	}
+	if !dl.network.Unlimited() {
+		l, ok := dl.networks[p.VLAN]
+		if !ok {
+			l = newAggregateLimit(dl.network)
+			dl.networks[p.VLAN] = l
+		}
+		limits = append(limits, memberLimit{l, member})
+	}
+	if !dl.total.Unlimited() {
+		limits = append(limits, memberLimit{dl.global, fmt.Sprintf("network %d", p.VLAN)})
+	}
+	return limits
+}
+
+// Upload returns the group limits applying to the uploads of a client.
+func (al *AggregateLimits) Upload(c *Client) []limiter {
+	p := c.Policy()
+	al.Lock()
+	defer al.Unlock()
+	return al.upload.limits(c, p)
+}
+
+// Download returns the group limits applying to the downloads of a client.
+func (al *AggregateLimits) Download(c *Client) []limiter {
+	p := c.Policy()
+	al.Lock()
+	defer al.Unlock()
+	return al.download.limits(c, p)
+}
@@ -0,0 +1,300 @@
+/* go-websockproxy - https://github.com/gdm85/go-websockproxy
+Copyright (C) 2016 gdm85
+
+This program is free software; you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation; either version 2 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License along
+with this program; if not, write to the Free Software Foundation, Inc.,
+51 Franklin Street, Fifth Floor, Boston, MA 02110-1301 USA.
+*/
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// severity is the severity of a log event.
+type severity int
+
+const (
+	levelDebug severity = iota
+	levelInfo
+	levelWarning
+	levelError
+)
+
+var levelNames = []string{"debug", "info", "warning", "error"}
+
+// String returns the name of the level.
+func (lvl severity) String() string {
+	return levelNames[lvl]
+}
+
+// parseLogLevel parses the name of a level.
+func parseLogLevel(s string) (severity, error) {
+	for i, name := range levelNames {
+		if s == name {
+			return severity(i), nil
+		}
+	}
+	return 0, fmt.Errorf("invalid log level %q", s)
+}
+
+// Logger emits the log events of a subsystem; each event has a stable name, so that it can be matched without parsing
+// its message, and the fields of the client it refers to, if any.
+type Logger struct {
+	subsystem string
+}
+
+// loggers of the subsystems
+var (
+	logMain   = newLogger("main")   // startup, shutdown and configuration
+	logConn   = newLogger("conn")   // websocket handshakes, connections, bans
+	logAuth   = newLogger("auth")   // authorization of clients
+	logSwitch = newLogger("switch") // switching and delivery of frames, TAP interface
+	logLimit  = newLogger("limit")  // rate limits, quotas, backpressure and impairments
+	logAdmin  = newLogger("admin")  // administrative interface
+)
+
+// subsystems holds the names of all subsystems, for validating the per-subsystem log levels.
+var subsystems = map[string]bool{}
+
+// newLogger returns the logger of a subsystem.
+func newLogger(subsystem string) *Logger {
+	subsystems[subsystem] = true
+	return &Logger{subsystem: subsystem}
+}
+
+// logConfig is the configuration of all loggers; it is set at startup, before any concurrent use.
+var logConfig = struct {
+	level  severity
+	levels map[string]severity
+	json   bool
+	// sampling is the max number of warnings with the same event name logged in each sampling interval; 0 to disable sampling
+	sampling int
+	out      io.Writer
+}{level: levelWarning, out: os.Stderr}
+
+// configureLogging applies the log options: the default level, the per-subsystem levels in the form
+// 'subsystem=level,...', the output format and the sampling of warnings.
+func configureLogging(level, levels, format string, sampling int) error {
+	var err error
+	logConfig.level, err = parseLogLevel(level)
+	if err != nil {
+		return err
+	}
+	logConfig.levels = map[string]severity{}
+	for _, spec := range strings.Split(levels, ",") {
+		spec = strings.TrimSpace(spec)
+		if spec == "" {
+			continue
+		}
+		i := strings.IndexByte(spec, '=')
+		if i == -1 {
+			return fmt.Errorf("invalid subsystem log level %q", spec)
+		}
+		subsystem := spec[:i]
+		if !subsystems[subsystem] {
+			return fmt.Errorf("unknown subsystem %q", subsystem)
+		}
+		logConfig.levels[subsystem], err = parseLogLevel(spec[i+1:])
+		if err != nil {
+			return err
+		}
+	}
+	switch format {
+	case "text":
+		logConfig.json = false
+	case "json":
+		logConfig.json = true
+	default:
+		return fmt.Errorf("invalid log format %q", format)
+	}
+	if sampling < 0 {
+		return fmt.Errorf("invalid log sampling %d", sampling)
+	}
+	logConfig.sampling = sampling
+	return nil
+}
+
+// logSamplingInterval is the interval over which warnings are sampled
+const logSamplingInterval = time.Second
+
+// eventSample counts the occurrences of an event in the current sampling interval.
+type eventSample struct {
+	start      time.Time
+	count      int
+	suppressed int
+}
+
+var (
+	samplesMu sync.Mutex
+	samples   = map[string]*eventSample{}
+)
+
+// sample returns true if an occurrence of the event should be logged, and the number of occurrences suppressed
+// since the last logged one.
+func sample(key string, now time.Time) (bool, int) {
+	samplesMu.Lock()
+	defer samplesMu.Unlock()
+	s, ok := samples[key]
+	if !ok {
+		s = &eventSample{start: now}
+		samples[key] = s
+	}
+	if now.Sub(s.start) >= logSamplingInterval {
+		s.start, s.count = now, 0
+	}
+	s.count++
+	if s.count > logConfig.sampling {
+		s.suppressed++
+		return false, 0
+	}
+	suppressed := s.suppressed
+	s.suppressed = 0
+	return true, suppressed
+}
+
+// enabled returns true if events of the level are logged for the subsystem.
+func (l *Logger) enabled(lvl severity) bool {
+	threshold, ok := logConfig.levels[l.subsystem]
+	if !ok {
+		threshold = logConfig.level
+	}
+	return lvl >= threshold
+}
+
+// Debug logs a debug event; c is the client the event refers to, or nil.
+func (l *Logger) Debug(event string, c *Client, format string, a ...interface{}) {
+	l.log(levelDebug, event, c, format, a)
+}
+
+// Info logs an informational event.
+func (l *Logger) Info(event string, c *Client, format string, a ...interface{}) {
+	l.log(levelInfo, event, c, format, a)
+}
+
+// Warning logs a warning event; repetitive warnings are sampled.
+func (l *Logger) Warning(event string, c *Client, format string, a ...interface{}) {
+	l.log(levelWarning, event, c, format, a)
+}
+
+// Error logs an error event.
+func (l *Logger) Error(event string, c *Client, format string, a ...interface{}) {
+	l.log(levelError, event, c, format, a)
+}
+
+// logField is a named value of a log event.
+type logField struct {
+	name  string
+	value interface{}
+}
+
+// logMu serializes the writing of log events.
+var logMu sync.Mutex
+
+// log writes an event of the level, unless the level is disabled for the subsystem or the warning is sampled out.
+func (l *Logger) log(lvl severity, event string, c *Client, format string, a []interface{}) {
+	if !l.enabled(lvl) {
+		return
+	}
+	now := time.Now()
+	var suppressed int
+	if lvl == levelWarning && logConfig.sampling != 0 {
+		var ok bool
+		ok, suppressed = sample(l.subsystem+"."+event, now)
+		if !ok {
+			return
+		}
+	}
+
+	fields := []logField{
+		{"time", now.UTC().Format(time.RFC3339Nano)},
+		{"level", lvl.String()},
+		{"subsystem", l.subsystem},
+		{"event", event},
+	}
+	if c != nil {
+		fields = append(fields, c.logFields()...)
+	}
+	if suppressed != 0 {
+		fields = append(fields, logField{"suppressed", suppressed})
+	}
+	fields = append(fields, logField{"msg", fmt.Sprintf(format, a...)})
+
+	var buf bytes.Buffer
+	if logConfig.json {
+		writeJSONEvent(&buf, fields)
+	} else {
+		writeTextEvent(&buf, fields)
+	}
+	logMu.Lock()
+	logConfig.out.Write(buf.Bytes())
+	logMu.Unlock()
+}
+
+// writeTextEvent writes the fields in the 'name=value' form, quoting values containing spaces or special characters.
+func writeTextEvent(buf *bytes.Buffer, fields []logField) {
+	for i, f := range fields {
+		if i != 0 {
+			buf.WriteByte(' ')
+		}
+		s := fmt.Sprint(f.value)
+		buf.WriteString(f.name)
+		buf.WriteByte('=')
+		if s == "" || strings.ContainsAny(s, " =\"\\\t\r\n") {
+			s = strconv.Quote(s)
+		}
+		buf.WriteString(s)
+	}
+	buf.WriteByte('\n')
+}
+
+// writeJSONEvent writes the fields as a JSON object, preserving their order.
+func writeJSONEvent(buf *bytes.Buffer, fields []logField) {
+	buf.WriteByte('{')
+	for i, f := range fields {
+		if i != 0 {
+			buf.WriteByte(',')
+		}
+		name, _ := json.Marshal(f.name)
+		buf.Write(name)
+		buf.WriteByte(':')
+		value, err := json.Marshal(f.value)
+		if err != nil {
+			value, _ = json.Marshal(fmt.Sprint(f.value))
+		}
+		buf.Write(value)
+	}
+	buf.WriteString("}\n")
+}
+
+// logFields returns the fields identifying the client in log events.
+func (c *Client) logFields() []logField {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	fields := []logField{{"client", c.id}, {"remote", c.remoteAddress}}
+	if c.mac != nil {
+		fields = append(fields, logField{"mac", c.mac.String()})
+	}
+	if c.authorized && c.policy != nil && c.policy.Identity != "" {
+		fields = append(fields, logField{"identity", c.policy.Identity})
+	}
+	return fields
+}
@@ -0,0 +1,266 @@
+/* go-websockproxy - https://github.com/gdm85/go-websockproxy
+Copyright (C) 2016 gdm85
+
+This program is free software; you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation; either version 2 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License along
+with this program; if not, write to the Free Software Foundation, Inc.,
+51 Franklin Street, Fifth Floor, Boston, MA 02110-1301 USA.
+*/
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// traffic directions, relative to the client
+const (
+	directionUpload   = "upload"
+	directionDownload = "download"
+)
+
+// trafficKey identifies the traffic counters of a direction, network and identity; the identity is empty unless
+// identity labels are enabled.
+type trafficKey struct {
+	direction string
+	vlan      int
+	identity  string
+}
+
+// trafficCounters are the frames and bytes counted for a traffic key.
+type trafficCounters struct {
+	frames, bytes uint64
+}
+
+// Metrics holds the counters exposed only at the metrics endpoint, in addition to the counters of stats.
+type Metrics struct {
+	sync.Mutex
+	traffic map[trafficKey]*trafficCounters
+}
+
+var metrics = &Metrics{traffic: map[trafficKey]*trafficCounters{}}
+
+// CountTraffic counts a frame of the specified size uploaded or downloaded by the client.
+func (m *Metrics) CountTraffic(c *Client, direction string, size int) {
+	p := c.Policy()
+	key := trafficKey{direction: direction, vlan: p.VLAN}
+	if metricsIdentityLabels {
+		key.identity = p.Identity
+	}
+	m.Lock()
+	tc, ok := m.traffic[key]
+	if !ok {
+		tc = &trafficCounters{}
+		m.traffic[key] = tc
+	}
+	tc.frames++
+	tc.bytes += uint64(size)
+	m.Unlock()
+}
+
+// dropReasons returns the counters of dropped frames, by reason.
+func (s *Stats) dropReasons() []counter {
+	return []counter{
+		{"too_short", &s.TooShortDrops},
+		{"unauthorized", &s.UnauthorizedDrops},
+		{"flagged", &s.FlaggedDrops},
+		{"spoofed_mac", &s.SpoofedMACDrops},
+		{"vlan_tagged", &s.TaggedDrops},
+		{"upload_rate_limit", &s.UploadRateLimitDrops},
+		{"download_rate_limit", &s.DownloadRateLimitDrops},
+		{"packet_rate_limit", &s.PacketRateDrops},
+		{"broadcast_rate_limit", &s.BroadcastDrops},
+		{"quarantine", &s.QuarantineDrops},
+		{"queue_overflow", &s.QueueOverflows},
+		{"memory_budget", &s.MemoryBudgetDrops},
+		{"degraded", &s.DegradedDrops},
+		{"uplink_queue", &s.UplinkDrops},
+		{"impairment", &s.ImpairmentDrops},
+	}
+}
+
+// handshakeOutcomes returns the counters of websocket handshakes, by outcome.
+func (s *Stats) handshakeOutcomes() []counter {
+	return []counter{
+		{"accepted", &s.HandshakesAccepted},
+		{"banned", &s.HandshakesBanned},
+		{"connection_limit", &s.HandshakesLimited},
+		{"origin_not_allowed", &s.HandshakesOriginRejected},
+		{"unauthorized", &s.HandshakesUnauthorized},
+		{"unavailable", &s.HandshakesUnavailable},
+	}
+}
+
+// labelEscaper escapes label values according to the Prometheus text format.
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// metricWriter writes metrics in the Prometheus text format.
+type metricWriter struct {
+	w io.Writer
+}
+
+// family writes the header of a metric family.
+func (mw metricWriter) family(name, kind, help string) {
+	fmt.Fprintf(mw.w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, kind)
+}
+
+// sample writes a sample of a metric; labels are pairs of names and values.
+func (mw metricWriter) sample(name string, value uint64, labels ...string) {
+	var b strings.Builder
+	b.WriteString(name)
+	if len(labels) != 0 {
+		b.WriteByte('{')
+		for i := 0; i < len(labels); i += 2 {
+			if i != 0 {
+				b.WriteByte(',')
+			}
+			fmt.Fprintf(&b, `%s="%s"`, labels[i], labelEscaper.Replace(labels[i+1]))
+		}
+		b.WriteByte('}')
+	}
+	fmt.Fprintf(mw.w, "%s %d\n", b.String(), value)
+}
+
+// clientKey groups the connected clients for the clients gauge.
+type clientKey struct {
+	vlan       int
+	identity   string
+	authorized bool
+}
+
+// Expose writes all metrics in the Prometheus text format.
+func (m *Metrics) Expose(w io.Writer) {
+	mw := metricWriter{w}
+
+	// connected clients and their queues
+	clients := map[clientKey]uint64{}
+	queued := map[int]uint64{}
+	for _, c := range hub.List() {
+		p := c.Policy()
+		key := clientKey{vlan: p.VLAN, authorized: c.isAuthorized()}
+		if metricsIdentityLabels {
+			key.identity = p.Identity
+		}
+		clients[key]++
+		queued[p.VLAN] += uint64(c.frames.Len())
+	}
+	keys := make([]clientKey, 0, len(clients))
+	for key := range clients {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].vlan != keys[j].vlan {
+			return keys[i].vlan < keys[j].vlan
+		}
+		if keys[i].identity != keys[j].identity {
+			return keys[i].identity < keys[j].identity
+		}
+		return !keys[i].authorized && keys[j].authorized
+	})
+	mw.family("wstap_clients", "gauge", "Connected clients.")
+	for _, key := range keys {
+		labels := []string{"network", strconv.Itoa(key.vlan), "authorized", strconv.FormatBool(key.authorized)}
+		if metricsIdentityLabels {
+			labels = append(labels, "identity", key.identity)
+		}
+		mw.sample("wstap_clients", clients[key], labels...)
+	}
+
+	vlans := make([]int, 0, len(queued))
+	for vlan := range queued {
+		vlans = append(vlans, vlan)
+	}
+	sort.Ints(vlans)
+	mw.family("wstap_queued_frames", "gauge", "Frames queued for delivery to clients.")
+	for _, vlan := range vlans {
+		mw.sample("wstap_queued_frames", queued[vlan], "network", strconv.Itoa(vlan))
+	}
+	mw.family("wstap_queued_bytes", "gauge", "Total size of the frames queued for delivery to clients.")
+	mw.sample("wstap_queued_bytes", uint64(atomic.LoadInt64(&hub.queuedBytes)))
+	mw.family("wstap_uplink_queued_frames", "gauge", "Frames of clients waiting to be written to the TAP interface.")
+	mw.sample("wstap_uplink_queued_frames", uint64(uplink.Len()))
+
+	// traffic of the clients
+	m.Lock()
+	traffic := make([]trafficKey, 0, len(m.traffic))
+	counters := make(map[trafficKey]trafficCounters, len(m.traffic))
+	for key, tc := range m.traffic {
+		traffic = append(traffic, key)
+		counters[key] = *tc
+	}
+	m.Unlock()
+	sort.Slice(traffic, func(i, j int) bool {
+		if traffic[i].direction != traffic[j].direction {
+			return traffic[i].direction < traffic[j].direction
+		}
+		if traffic[i].vlan != traffic[j].vlan {
+			return traffic[i].vlan < traffic[j].vlan
+		}
+		return traffic[i].identity < traffic[j].identity
+	})
+	for _, f := range []struct {
+		name, help string
+		value      func(trafficCounters) uint64
+	}{
+		{"wstap_frames_total", "Frames uploaded and downloaded by clients.", func(tc trafficCounters) uint64 { return tc.frames }},
+		{"wstap_bytes_total", "Bytes uploaded and downloaded by clients.", func(tc trafficCounters) uint64 { return tc.bytes }},
+	} {
+		mw.family(f.name, "counter", f.help)
+		for _, key := range traffic {
+			labels := []string{"direction", key.direction, "network", strconv.Itoa(key.vlan)}
+			if metricsIdentityLabels {
+				labels = append(labels, "identity", key.identity)
+			}
+			mw.sample(f.name, f.value(counters[key]), labels...)
+		}
+	}
+
+	// counters of stats; those broken down by label are not repeated on their own
+	labelled := map[*uint64]bool{}
+	mw.family("wstap_dropped_frames_total", "counter", "Frames dropped, by reason.")
+	for _, c := range stats.dropReasons() {
+		labelled[c.value] = true
+		mw.sample("wstap_dropped_frames_total", atomic.LoadUint64(c.value), "reason", c.name)
+	}
+	mw.family("wstap_handshakes_total", "counter", "Websocket handshakes, by outcome.")
+	for _, c := range stats.handshakeOutcomes() {
+		labelled[c.value] = true
+		mw.sample("wstap_handshakes_total", atomic.LoadUint64(c.value), "outcome", c.name)
+	}
+	for _, c := range stats.counters() {
+		if labelled[c.value] {
+			continue
+		}
+		name := "wstap_" + c.name + "_total"
+		mw.family(name, "counter", "Count of "+strings.Replace(c.name, "_", " ", -1)+".")
+		mw.sample(name, atomic.LoadUint64(c.value))
+	}
+}
+
+// serveMetrics responds with all metrics in the Prometheus text format.
+func serveMetrics(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	metrics.Expose(w)
+}
+
+// newMetricsHandler returns the handler of the metrics endpoint, for listening on its own address.
+func newMetricsHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/metrics", serveMetrics)
+	return mux
+}
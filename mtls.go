@@ -0,0 +1,192 @@
+/* go-websockproxy - https://github.com/gdm85/go-websockproxy
+Copyright (C) 2016 gdm85
+
+This program is free software; you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation; either version 2 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License along
+with this program; if not, write to the Free Software Foundation, Inc.,
+51 Franklin Street, Fifth Floor, Boston, MA 02110-1301 USA.
+*/
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"time"
+)
+
+// clientCAs are the certificate authorities of the client certificates, loaded at startup
+var clientCAs []*x509.Certificate
+
+var errCertificateRevoked = errors.New("client certificate revoked")
+
+// certificateID identifies a certificate for revocation: serial numbers are unique only among the certificates of the
+// same issuer.
+type certificateID struct {
+	issuer, serial string
+}
+
+// newCertificateID returns the identifier of a certificate.
+func newCertificateID(cert *x509.Certificate) certificateID {
+	return certificateID{issuer: cert.Issuer.String(), serial: cert.SerialNumber.String()}
+}
+
+// String returns a human-readable description of the certificate identifier.
+func (id certificateID) String() string {
+	return fmt.Sprintf("%s issued by %q", id.serial, id.issuer)
+}
+
+// loadClientCAs loads the PEM bundle of certificate authorities for client certificates.
+func loadClientCAs(path string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	for {
+		var block *pem.Block
+		block, data = pem.Decode(data)
+		if block == nil {
+			break
+		}
+		if block.Type != "CERTIFICATE" {
+			continue
+		}
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return fmt.Errorf("parsing %s: %v", path, err)
+		}
+		clientCAs = append(clientCAs, cert)
+	}
+	if len(clientCAs) == 0 {
+		return fmt.Errorf("no certificates found in %s", path)
+	}
+	return nil
+}
+
+// newTLSConfig returns the TLS configuration for verifying client certificates; clients without certificate are still
+// accepted and can authorize with the other methods.
+func newTLSConfig() *tls.Config {
+	pool := x509.NewCertPool()
+	for _, ca := range clientCAs {
+		pool.AddCert(ca)
+	}
+	return &tls.Config{
+		ClientCAs:             pool,
+		ClientAuth:            tls.VerifyClientCertIfGiven,
+		VerifyPeerCertificate: verifyClientCertificate,
+	}
+}
+
+// verifyClientCertificate rejects client certificates revoked by the CRL.
+func verifyClientCertificate(rawCerts [][]byte, verifiedChains [][]*x509.Certificate) error {
+	if len(verifiedChains) == 0 {
+		return nil
+	}
+	if hub.Config().revoked[newCertificateID(verifiedChains[0][0])] {
+		return errCertificateRevoked
+	}
+	return nil
+}
+
+// loadCRL loads the revoked client certificates from a PEM or DER encoded CRL, which must be
+// signed by one of the client certificate authorities.
+func (cfg *Config) loadCRL() error {
+	data, err := os.ReadFile(cfg.ClientCRLFile)
+	if err != nil {
+		return err
+	}
+	if block, _ := pem.Decode(data); block != nil {
+		data = block.Bytes
+	}
+	crl, err := x509.ParseRevocationList(data)
+	if err != nil {
+		return fmt.Errorf("parsing %s: %v", cfg.ClientCRLFile, err)
+	}
+
+	var signed bool
+	for _, ca := range clientCAs {
+		if crl.CheckSignatureFrom(ca) == nil {
+			signed = true
+			break
+		}
+	}
+	if !signed {
+		return fmt.Errorf("%s is not signed by any client certificate authority", cfg.ClientCRLFile)
+	}
+	if !crl.NextUpdate.IsZero() && time.Now().After(crl.NextUpdate) {
+		logAuth.Warning("crl_outdated", nil, "%s is past its next update time (%v)", cfg.ClientCRLFile, crl.NextUpdate)
+	}
+
+	cfg.revoked = map[certificateID]bool{}
+	issuer := crl.Issuer.String()
+	for _, entry := range crl.RevokedCertificateEntries {
+		cfg.revoked[certificateID{issuer: issuer, serial: entry.SerialNumber.String()}] = true
+	}
+	return nil
+}
+
+// requestCertificate returns the verified client certificate of the request, if any.
+func requestCertificate(r *http.Request) *x509.Certificate {
+	if r.TLS == nil || len(r.TLS.VerifiedChains) == 0 {
+		return nil
+	}
+	return r.TLS.VerifiedChains[0][0]
+}
+
+// certificateIdentity returns the identity of the certificate holder: its common name or else its first subject alternative name.
+func certificateIdentity(cert *x509.Certificate) string {
+	switch {
+	case cert.Subject.CommonName != "":
+		return cert.Subject.CommonName
+	case len(cert.DNSNames) != 0:
+		return cert.DNSNames[0]
+	case len(cert.EmailAddresses) != 0:
+		return cert.EmailAddresses[0]
+	case len(cert.URIs) != 0:
+		return cert.URIs[0].String()
+	}
+	return ""
+}
+
+// certificatePolicy returns the policy of a client authenticated with a verified certificate, or nil if the certificate
+// has no identity.
+func (cfg *Config) certificatePolicy(cert *x509.Certificate) *Policy {
+	identity := certificateIdentity(cert)
+	if identity == "" {
+		return nil
+	}
+	p := cfg.identityPolicy(identity, credentialCertificate, cert.SerialNumber.String(), cert.NotAfter)
+	p.certificate = cert
+	return p
+}
+
+// identityPolicy returns a copy of the policy of the key file entry for the identity, or the default policy if there is
+// none, for a client which authorized with another kind of credential; the earliest expiry applies.
+func (cfg *Config) identityPolicy(identity string, credential credentialKind, key string, expires time.Time) *Policy {
+	var p Policy
+	if np, ok := cfg.identities[identity]; ok {
+		p = *np
+	} else {
+		p = *cfg.defaultPolicy()
+		p.Identity = identity
+	}
+	p.credential = credential
+	p.key = key
+	if !expires.IsZero() && (p.Expires.IsZero() || expires.Before(p.Expires)) {
+		p.Expires = expires
+	}
+	return &p
+}
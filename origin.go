@@ -0,0 +1,94 @@
+/* go-websockproxy - https://github.com/gdm85/go-websockproxy
+Copyright (C) 2016 gdm85
+
+This program is free software; you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation; either version 2 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License along
+with this program; if not, write to the Free Software Foundation, Inc.,
+51 Franklin Street, Fifth Floor, Boston, MA 02110-1301 USA.
+*/
+package main
+
+import (
+	"errors"
+	"net/url"
+	"path"
+	"strings"
+)
+
+// errOriginNotAllowed is returned for websocket handshakes with an Origin outside of the allowlist
+var errOriginNotAllowed = errors.New("origin not allowed")
+
+// originPattern is an entry of the Origin allowlist; scheme is empty when any scheme is allowed, host contains
+// the port only when a specific port is required.
+type originPattern struct {
+	scheme string
+	host   string
+}
+
+// parseAllowedOrigins parses a comma-separated list of origins, either exact ('https://example.com', 'example.com:8080')
+// or with wildcards ('*.example.com').
+func parseAllowedOrigins(s string) ([]originPattern, error) {
+	var patterns []originPattern
+	for _, entry := range strings.Split(s, ",") {
+		entry = strings.ToLower(strings.TrimSpace(entry))
+		if entry == "" {
+			continue
+		}
+		var p originPattern
+		if i := strings.Index(entry, "://"); i != -1 {
+			p.scheme, entry = entry[:i], entry[i+3:]
+		}
+		if entry == "" || strings.ContainsAny(entry, "/?#") {
+			return nil, errors.New("invalid origin: " + entry)
+		}
+		if _, err := path.Match(entry, ""); err != nil {
+			return nil, errors.New("invalid origin pattern: " + entry)
+		}
+		p.host = entry
+		patterns = append(patterns, p)
+	}
+	return patterns, nil
+}
+
+// match returns true if the origin URL matches the pattern.
+func (p originPattern) match(origin *url.URL) bool {
+	if p.scheme != "" && p.scheme != strings.ToLower(origin.Scheme) {
+		return false
+	}
+	host := strings.ToLower(origin.Host)
+	if !strings.Contains(p.host, ":") {
+		host = strings.ToLower(origin.Hostname())
+	}
+	ok, _ := path.Match(p.host, host)
+	return ok
+}
+
+// checkOrigin verifies the Origin header of a websocket handshake against the allowlist; when the allowlist is
+// enforced only for unauthenticated networks, origins are not checked if the proxy requires authorization.
+func checkOrigin(origin string, cfg *Config) error {
+	if len(allowedOrigins) == 0 {
+		return nil
+	}
+	if originCheck == "unauthenticated" && cfg.authRequired() {
+		return nil
+	}
+	u, err := url.Parse(origin)
+	if err != nil || u.Host == "" {
+		return errOriginNotAllowed
+	}
+	for _, p := range allowedOrigins {
+		if p.match(u) {
+			return nil
+		}
+	}
+	return errOriginNotAllowed
+}
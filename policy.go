@@ -0,0 +1,256 @@
+/* go-websockproxy - https://github.com/gdm85/go-websockproxy
+Copyright (C) 2016 gdm85
+
+This program is free software; you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation; either version 2 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License along
+with this program; if not, write to the Free Software Foundation, Inc.,
+51 Franklin Street, Fifth Floor, Boston, MA 02110-1301 USA.
+*/
+package main
+
+import (
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"time"
+)
+
+// Policy is the set of settings applied to the traffic of a client.
+type Policy struct {
+	// Identity is the name of the credential used by the client; it is empty for clients authorized
+	// with the shared key or when authorization is disabled
+	Identity string
+	// VLAN is the virtual network of the client, 0 being the untagged default network
+	VLAN        int
+	MACPrefix   string
+	MaxSessions int
+	Expires     time.Time
+
+	uploadBandwidth, downloadBandwidth, controlBandwidth Bandwidth
+	// quota is the traffic allowed to the identity in each quota period, 0 for unlimited
+	quota int64
+	// uplinkWeight is the weight of the client in the scheduling of the frames written to the TAP interface
+	uplinkWeight int
+	credential   credentialKind
+	// key is the AUTH key, the access token or the serial number of the certificate the client authorized with
+	key string
+	// certificate is the client certificate the client authorized with, if any
+	certificate *x509.Certificate
+}
+
+// credentialKind is the kind of credential a client authorized with.
+type credentialKind int
+
+const (
+	credentialKey credentialKind = iota
+	credentialToken
+	credentialCertificate
+	credentialWebhook
+)
+
+// KeyEntry is an entry of the key file.
+type KeyEntry struct {
+	Identity             string `json:"identity"`
+	Key                  string `json:"key"`
+	VLAN                 int    `json:"vlan"`
+	MACPrefix            string `json:"mac-prefix"`
+	MaxUploadBandwidth   string `json:"max-upload-bandwidth"`
+	MaxDownloadBandwidth string `json:"max-download-bandwidth"`
+	MaxSessions          int    `json:"max-sessions"`
+	// Quota is the traffic allowed to the identity in each quota period, e.g. '10GiB'
+	Quota string `json:"quota"`
+	// UplinkWeight is the share of the TAP uplink of each client of the identity relative to the others, 1 by default
+	UplinkWeight int `json:"uplink-weight"`
+	// Expires is either a date, meaning that the key is valid until the end of that day (UTC), or a RFC 3339 timestamp
+	Expires string `json:"expires"`
+}
+
+var (
+	errKeyExpired      = errors.New("AUTH key expired")
+	errTooManySessions = errors.New("too many sessions for this identity")
+)
+
+// defaultPolicy returns the policy of clients authorized with the shared key or connected when authorization is disabled.
+func (cfg *Config) defaultPolicy() *Policy {
+	return &Policy{
+		MACPrefix:         cfg.MACPrefix,
+		uploadBandwidth:   cfg.uploadBandwidth,
+		downloadBandwidth: cfg.downloadBandwidth,
+		controlBandwidth:  cfg.controlBandwidth,
+		quota:             cfg.quota,
+		key:               cfg.AuthKey,
+	}
+}
+
+// authRequired returns true if clients need to authorize before sending traffic.
+func (cfg *Config) authRequired() bool {
+	return cfg.AuthKey != "" || cfg.KeyFile != "" || cfg.TokenSecret != "" || cfg.AuthWebhook != "" || clientCAFile != ""
+}
+
+// loadKeyFile loads the entries of the key file, using the global settings for the unspecified limits.
+func (cfg *Config) loadKeyFile() error {
+	f, err := os.Open(cfg.KeyFile)
+	if err != nil {
+		return err
+	}
+	var entries []KeyEntry
+	dec := json.NewDecoder(f)
+	dec.DisallowUnknownFields()
+	err = dec.Decode(&entries)
+	f.Close()
+	if err != nil {
+		return fmt.Errorf("parsing %s: %v", cfg.KeyFile, err)
+	}
+
+	cfg.keys = map[string]*Policy{}
+	cfg.identities = map[string]*Policy{}
+	cfg.reservedMACs = map[string]string{}
+	for i, entry := range entries {
+		p, err := cfg.newPolicy(&entry)
+		if err != nil {
+			return fmt.Errorf("%s: entry %d: %v", cfg.KeyFile, i+1, err)
+		}
+		if _, ok := cfg.identities[p.Identity]; ok {
+			return fmt.Errorf("%s: entry %d: duplicate identity %q", cfg.KeyFile, i+1, p.Identity)
+		}
+		if _, ok := cfg.keys[p.key]; ok || p.key == cfg.AuthKey {
+			return fmt.Errorf("%s: entry %d: duplicate key", cfg.KeyFile, i+1)
+		}
+		cfg.keys[p.key] = p
+		cfg.identities[p.Identity] = p
+		// a complete MAC address can be used only by its identity
+		if mac, err := net.ParseMAC(p.MACPrefix); err == nil && len(mac) == 6 {
+			cfg.reservedMACs[mac.String()] = p.Identity
+		}
+	}
+	return nil
+}
+
+// newPolicy returns the policy for a key file entry.
+func (cfg *Config) newPolicy(entry *KeyEntry) (*Policy, error) {
+	if entry.Identity == "" {
+		return nil, errors.New("missing identity")
+	}
+	if entry.Key == "" {
+		return nil, errors.New("missing key")
+	}
+	if entry.VLAN < 0 || entry.VLAN > 4094 {
+		return nil, fmt.Errorf("invalid VLAN %d", entry.VLAN)
+	}
+	if entry.MaxSessions < 0 {
+		return nil, errors.New("invalid max sessions")
+	}
+	if entry.UplinkWeight < 0 {
+		return nil, errors.New("invalid uplink weight")
+	}
+
+	p := cfg.defaultPolicy()
+	p.Identity = entry.Identity
+	p.key = entry.Key
+	p.VLAN = entry.VLAN
+	p.MaxSessions = entry.MaxSessions
+	p.uplinkWeight = entry.UplinkWeight
+	if entry.MACPrefix != "" {
+		p.MACPrefix = entry.MACPrefix
+	}
+
+	var err error
+	if entry.MaxUploadBandwidth != "" {
+		p.uploadBandwidth, err = parseBandwidth(entry.MaxUploadBandwidth)
+		if err != nil {
+			return nil, fmt.Errorf("invalid upload bandwidth: %v", err)
+		}
+	}
+	if entry.MaxDownloadBandwidth != "" {
+		p.downloadBandwidth, err = parseBandwidth(entry.MaxDownloadBandwidth)
+		if err != nil {
+			return nil, fmt.Errorf("invalid download bandwidth: %v", err)
+		}
+	}
+	if entry.Quota != "" {
+		p.quota, err = parseQuota(entry.Quota)
+		if err != nil {
+			return nil, fmt.Errorf("invalid quota: %v", err)
+		}
+	}
+	if entry.Expires != "" {
+		p.Expires, err = parseExpiry(entry.Expires)
+		if err != nil {
+			return nil, fmt.Errorf("invalid expiry: %v", err)
+		}
+	}
+	return p, nil
+}
+
+// parseExpiry parses either a date, returning the end of that day (UTC), or a RFC 3339 timestamp.
+func parseExpiry(s string) (time.Time, error) {
+	if t, err := time.Parse("2006-01-02", s); err == nil {
+		return t.AddDate(0, 0, 1), nil
+	}
+	return time.Parse(time.RFC3339, s)
+}
+
+// reauthorize returns the policy and authorization state of a client according to the configuration, given its current
+// ones: the credential the client authorized with must still be valid.
+func (cfg *Config) reauthorize(p *Policy, authorized bool) (*Policy, bool) {
+	if !cfg.authRequired() {
+		return cfg.defaultPolicy(), true
+	}
+	if !authorized {
+		return cfg.defaultPolicy(), false
+	}
+	switch p.credential {
+	case credentialToken:
+		np, err := cfg.verifyToken(p.key, time.Now())
+		if err != nil {
+			return cfg.defaultPolicy(), false
+		}
+		return np, true
+	case credentialCertificate:
+		if p.certificate == nil || cfg.revoked[newCertificateID(p.certificate)] {
+			return cfg.defaultPolicy(), false
+		}
+		// the expiry is that of the certificate, bounded by the current key file entry of the identity
+		return cfg.certificatePolicy(p.certificate), true
+	case credentialWebhook:
+		// decisions of the webhook hold until the policy expires
+		return p, cfg.AuthWebhook != ""
+	}
+	if p.Identity == "" {
+		return cfg.defaultPolicy(), cfg.AuthKey != "" && p.key == cfg.AuthKey
+	}
+	np, ok := cfg.identities[p.Identity]
+	if !ok || np.key != p.key || np.Expired(time.Now()) {
+		return cfg.defaultPolicy(), false
+	}
+	return np, true
+}
+
+// maxSessions returns the max number of sessions of the identity of the policy, 0 for unlimited; clients without
+// identity are not limited.
+func (p *Policy) maxSessions() int {
+	if p.MaxSessions != 0 {
+		return p.MaxSessions
+	}
+	if p.Identity == "" {
+		return 0
+	}
+	return maxSessionsPerIdentity
+}
+
+// Expired returns true if the policy has an expiry which is past.
+func (p *Policy) Expired(now time.Time) bool {
+	return !p.Expires.IsZero() && !now.Before(p.Expires)
+}
@@ -0,0 +1,340 @@
+/* go-websockproxy - https://github.com/gdm85/go-websockproxy
+Copyright (C) 2016 gdm85
+
+This program is free software; you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation; either version 2 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License along
+with this program; if not, write to the Free Software Foundation, Inc.,
+51 Franklin Street, Fifth Floor, Boston, MA 02110-1301 USA.
+*/
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/songgao/water/waterutil"
+)
+
+// priorityClass is the scheduling class of a frame queued for delivery to a client; lower values have higher priority.
+type priorityClass int
+
+const (
+	// priorityControl is for the traffic guests need to keep their network configuration: ARP, DHCP, ICMP and ICMPv6
+	priorityControl priorityClass = iota
+	// priorityInteractive is for small latency-sensitive traffic: DNS and TCP segments without payload
+	priorityInteractive
+	// priorityBulk is for everything else
+	priorityBulk
+
+	numPriorityClasses
+)
+
+// well-known UDP ports of control and interactive traffic
+const (
+	portDNS          = 53
+	portDHCPServer   = 67
+	portDHCPClient   = 68
+	portDHCPv6Client = 546
+	portDHCPv6Server = 547
+)
+
+// String returns the name of the priority class.
+func (p priorityClass) String() string {
+	switch p {
+	case priorityControl:
+		return "control"
+	case priorityInteractive:
+		return "interactive"
+	case priorityBulk:
+		return "bulk"
+	}
+	return "unknown"
+}
+
+// classifyFrame returns the priority class of an ethernet frame.
+func classifyFrame(frame []byte) priorityClass {
+	if len(frame) < 14 || len(frame) < 14+int(waterutil.MACTagging(frame)) {
+		return priorityBulk
+	}
+	payload := waterutil.MACPayload(frame)
+	switch waterutil.MACEthertype(frame) {
+	case waterutil.ARP:
+		return priorityControl
+	case waterutil.IPv4:
+		if len(payload) < 20 {
+			return priorityBulk
+		}
+		headerLen := int(payload[0]&0x0f) * 4
+		if headerLen < 20 || len(payload) < headerLen {
+			return priorityBulk
+		}
+		return classifyTransport(waterutil.IPProtocol(payload[9]), payload[headerLen:])
+	case waterutil.IPv6:
+		// extension headers are not followed
+		if len(payload) < 40 {
+			return priorityBulk
+		}
+		return classifyTransport(waterutil.IPProtocol(payload[6]), payload[40:])
+	}
+	return priorityBulk
+}
+
+// classifyTransport returns the priority class of an IP packet given its transport protocol and payload.
+func classifyTransport(protocol waterutil.IPProtocol, segment []byte) priorityClass {
+	switch protocol {
+	case waterutil.ICMP, waterutil.IPv6_ICMP:
+		return priorityControl
+	case waterutil.UDP:
+		if len(segment) < 8 {
+			return priorityBulk
+		}
+		src, dst := binary.BigEndian.Uint16(segment[0:2]), binary.BigEndian.Uint16(segment[2:4])
+		for _, port := range []uint16{src, dst} {
+			switch port {
+			case portDHCPServer, portDHCPClient, portDHCPv6Client, portDHCPv6Server:
+				return priorityControl
+			case portDNS:
+				return priorityInteractive
+			}
+		}
+	case waterutil.TCP:
+		if len(segment) < 20 {
+			return priorityBulk
+		}
+		// segments carrying no data (handshakes, pure ACKs) are needed to keep bulk transfers flowing
+		if len(segment) <= int(segment[12]>>4)*4 {
+			return priorityInteractive
+		}
+	}
+	return priorityBulk
+}
+
+// parsePriorityScheduling parses the scheduling mode of the priority classes: 'strict' or comma-separated weights
+// for the control, interactive and bulk classes; strict scheduling is represented by nil weights.
+func parsePriorityScheduling(s string) ([]int, error) {
+	if s == "strict" {
+		return nil, nil
+	}
+	parts := strings.Split(s, ",")
+	if len(parts) != int(numPriorityClasses) {
+		return nil, fmt.Errorf("expected 'strict' or %d comma-separated weights", numPriorityClasses)
+	}
+	weights := make([]int, len(parts))
+	for i, part := range parts {
+		w, err := strconv.Atoi(strings.TrimSpace(part))
+		if err != nil {
+			return nil, err
+		}
+		if w <= 0 {
+			return nil, fmt.Errorf("weight of %s class must be positive", priorityClass(i))
+		}
+		weights[i] = w
+	}
+	return weights, nil
+}
+
+// frameQueue is a bounded queue of frames pending delivery to a client, with one FIFO for each priority class.
+// Frames are dequeued with strict priority or, when weights are specified, with weighted round robin among classes.
+type frameQueue struct {
+	sync.Mutex
+	classes  [numPriorityClasses][][]byte
+	capacity int
+	pending  int
+	bytes    int64
+	weights  []int
+	credits  [numPriorityClasses]int
+
+	// saturatedSince is the time of the first frame dropped because of a full class queue; it is reset
+	// once no class queue is more than half full
+	saturatedSince time.Time
+
+	// usage is the total size of the frames queued by all clients, updated atomically
+	usage *int64
+
+	// ready is signalled when frames are queued
+	ready chan struct{}
+	// drained is closed when the queue becomes empty; it is created only when somebody waits for it
+	drained chan struct{}
+}
+
+// newFrameQueue returns a queue holding at most capacity frames for each priority class; the size of queued frames
+// is accounted in usage.
+func newFrameQueue(capacity int, weights []int, usage *int64) *frameQueue {
+	return &frameQueue{
+		capacity: capacity,
+		weights:  weights,
+		usage:    usage,
+		ready:    make(chan struct{}, 1),
+	}
+}
+
+// Push queues a frame; it returns false if the queue of its class is full and the frame was dropped.
+func (q *frameQueue) Push(class priorityClass, frame []byte) bool {
+	q.Lock()
+	if len(q.classes[class]) >= q.capacity {
+		if q.saturatedSince.IsZero() {
+			q.saturatedSince = time.Now()
+		}
+		q.Unlock()
+		return false
+	}
+	q.classes[class] = append(q.classes[class], frame)
+	q.pending++
+	q.bytes += int64(len(frame))
+	atomic.AddInt64(q.usage, int64(len(frame)))
+	q.Unlock()
+
+	select {
+	case q.ready <- struct{}{}:
+	default:
+	}
+	return true
+}
+
+// Pop dequeues the next frame to deliver; it returns false if the queue is empty.
+func (q *frameQueue) Pop() ([]byte, priorityClass, bool) {
+	q.Lock()
+	defer q.Unlock()
+	if q.pending == 0 {
+		return nil, 0, false
+	}
+
+	class := q.next()
+	frame := q.classes[class][0]
+	q.classes[class][0] = nil
+	q.classes[class] = q.classes[class][1:]
+	q.pending--
+	q.bytes -= int64(len(frame))
+	atomic.AddInt64(q.usage, -int64(len(frame)))
+	q.notifyDrained()
+
+	if !q.saturatedSince.IsZero() {
+		drained := true
+		for c := range q.classes {
+			if len(q.classes[c]) > q.capacity/2 {
+				drained = false
+				break
+			}
+		}
+		if drained {
+			q.saturatedSince = time.Time{}
+		}
+	}
+	return frame, class, true
+}
+
+// SaturatedFor returns for how long the queue has been dropping frames; zero if it is not saturated.
+func (q *frameQueue) SaturatedFor(now time.Time) time.Duration {
+	q.Lock()
+	defer q.Unlock()
+	if q.saturatedSince.IsZero() {
+		return 0
+	}
+	return now.Sub(q.saturatedSince)
+}
+
+// next returns the class of the next frame to dequeue; queue must not be empty.
+func (q *frameQueue) next() priorityClass {
+	if q.weights == nil {
+		for class := range q.classes {
+			if len(q.classes[class]) != 0 {
+				return priorityClass(class)
+			}
+		}
+	}
+
+	for {
+		for class := range q.classes {
+			if len(q.classes[class]) != 0 && q.credits[class] > 0 {
+				q.credits[class]--
+				return priorityClass(class)
+			}
+		}
+		// all backlogged classes used their share for this round
+		for class := range q.credits {
+			q.credits[class] = q.weights[class]
+		}
+	}
+}
+
+// DropOldest drops the oldest frame of the lowest priority class with frames pending; it returns the size of the dropped
+// frame, or zero if the queue is empty.
+func (q *frameQueue) DropOldest() int {
+	q.Lock()
+	defer q.Unlock()
+	for class := len(q.classes) - 1; class >= 0; class-- {
+		if len(q.classes[class]) == 0 {
+			continue
+		}
+		size := len(q.classes[class][0])
+		q.classes[class][0] = nil
+		q.classes[class] = q.classes[class][1:]
+		q.pending--
+		q.bytes -= int64(size)
+		atomic.AddInt64(q.usage, -int64(size))
+		q.notifyDrained()
+		return size
+	}
+	return 0
+}
+
+// Clear drops all frames in the queue.
+func (q *frameQueue) Clear() {
+	q.Lock()
+	for class := range q.classes {
+		q.classes[class] = nil
+	}
+	q.pending = 0
+	atomic.AddInt64(q.usage, -q.bytes)
+	q.bytes = 0
+	q.notifyDrained()
+	q.Unlock()
+}
+
+// Drained returns a channel which is closed once the queue is empty.
+func (q *frameQueue) Drained() <-chan struct{} {
+	q.Lock()
+	defer q.Unlock()
+	if q.drained == nil {
+		q.drained = make(chan struct{})
+	}
+	ch := q.drained
+	q.notifyDrained()
+	return ch
+}
+
+// notifyDrained wakes up those waiting for the queue to be empty, if it is; queue must be locked by the caller.
+func (q *frameQueue) notifyDrained() {
+	if q.pending == 0 && q.drained != nil {
+		close(q.drained)
+		q.drained = nil
+	}
+}
+
+// Bytes returns the total size of the frames in the queue.
+func (q *frameQueue) Bytes() int64 {
+	q.Lock()
+	defer q.Unlock()
+	return q.bytes
+}
+
+// Len returns the number of frames in the queue.
+func (q *frameQueue) Len() int {
+	q.Lock()
+	defer q.Unlock()
+	return q.pending
+}
@@ -0,0 +1,232 @@
+/* go-websockproxy - https://github.com/gdm85/go-websockproxy
+Copyright (C) 2016 gdm85
+
+This program is free software; you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation; either version 2 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License along
+with this program; if not, write to the Free Software Foundation, Inc.,
+51 Franklin Street, Fifth Floor, Boston, MA 02110-1301 USA.
+*/
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// interval between two saves of the quota state file
+const quotaSaveInterval = time.Minute
+
+var errQuotaExceeded = errors.New("traffic quota exceeded")
+
+// quotaEvent is a change of the quota state of an identity which clients are notified of.
+type quotaEvent int
+
+const (
+	quotaNone quotaEvent = iota
+	quotaNear
+	quotaExhausted
+)
+
+// quotaUsage is the traffic of an identity in the current quota period.
+type quotaUsage struct {
+	Period string `json:"period"`
+	Bytes  int64  `json:"bytes"`
+	Warned bool   `json:"warned"`
+	// Quota is the quota the warning refers to; zero in state files saved by previous versions
+	Quota int64 `json:"quota,omitempty"`
+}
+
+// QuotaTracker accounts the traffic of each identity in the current period (day or month); usage can be persisted to
+// a state file, so that it survives restarts. Clients authorized with the shared key are accounted together.
+type QuotaTracker struct {
+	sync.Mutex
+	usage map[string]*quotaUsage
+	path  string
+	dirty bool
+}
+
+var quotas = &QuotaTracker{usage: map[string]*quotaUsage{}}
+
+// quotaPeriod returns the name of the quota period of the specified time, in UTC.
+func quotaPeriod(now time.Time) string {
+	if quotaPeriodLength == "day" {
+		return now.UTC().Format("2006-01-02")
+	}
+	return now.UTC().Format("2006-01")
+}
+
+// Load loads the usage persisted in the state file, which is also used for saving it afterwards; a missing file is not an error.
+func (qt *QuotaTracker) Load(path string) error {
+	qt.Lock()
+	defer qt.Unlock()
+	qt.path = path
+
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	var usage map[string]*quotaUsage
+	if err := json.Unmarshal(data, &usage); err != nil {
+		return fmt.Errorf("parsing %s: %v", path, err)
+	}
+	if usage == nil {
+		return fmt.Errorf("parsing %s: no usage found", path)
+	}
+	for identity, u := range usage {
+		if u == nil {
+			return fmt.Errorf("parsing %s: no usage found for identity %q", path, identity)
+		}
+	}
+	qt.usage = usage
+	return nil
+}
+
+// Save persists the usage to the state file, if any and if it changed since the last save.
+func (qt *QuotaTracker) Save() {
+	qt.Lock()
+	defer qt.Unlock()
+	if qt.path == "" || !qt.dirty {
+		return
+	}
+	period := quotaPeriod(time.Now())
+	for identity, u := range qt.usage {
+		if u.Period != period {
+			delete(qt.usage, identity)
+		}
+	}
+	data, err := json.MarshalIndent(qt.usage, "", "\t")
+	if err != nil {
+		logLimit.Error("quota_state_save_failed", nil, "saving quota state: %v", err)
+		return
+	}
+	tmp := qt.path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0600); err != nil {
+		logLimit.Error("quota_state_save_failed", nil, "saving quota state: %v", err)
+		return
+	}
+	if err := os.Rename(tmp, qt.path); err != nil {
+		logLimit.Error("quota_state_save_failed", nil, "saving quota state: %v", err)
+		return
+	}
+	qt.dirty = false
+}
+
+// saveLoop saves the usage periodically.
+func (qt *QuotaTracker) saveLoop() {
+	for range time.Tick(quotaSaveInterval) {
+		qt.Save()
+	}
+}
+
+// current returns the usage of the identity in the current period; tracker must be locked by the caller.
+func (qt *QuotaTracker) current(identity string) *quotaUsage {
+	period := quotaPeriod(time.Now())
+	u, ok := qt.usage[identity]
+	if !ok || u.Period != period {
+		u = &quotaUsage{Period: period}
+		qt.usage[identity] = u
+	}
+	return u
+}
+
+// Account adds the bytes transferred by a client to the usage of its identity; it returns the usage and the event
+// clients of the identity should be notified of.
+func (qt *QuotaTracker) Account(identity string, n int, quota int64) (int64, quotaEvent) {
+	qt.Lock()
+	defer qt.Unlock()
+	u := qt.current(identity)
+	if u.Quota != quota {
+		// the warning is sent again if the usage gets near the new quota
+		if u.Quota != 0 {
+			u.Warned = false
+		}
+		u.Quota = quota
+	}
+	before := u.Bytes
+	u.Bytes += int64(n)
+	qt.dirty = true
+
+	switch {
+	case before < quota && u.Bytes >= quota:
+		return u.Bytes, quotaExhausted
+	case !u.Warned && u.Bytes*100 >= quota*int64(quotaWarning):
+		u.Warned = true
+		return u.Bytes, quotaNear
+	}
+	return u.Bytes, quotaNone
+}
+
+// Exceeded returns true if the identity used its quota in the current period.
+func (qt *QuotaTracker) Exceeded(identity string, quota int64) bool {
+	if quota == 0 {
+		return false
+	}
+	qt.Lock()
+	defer qt.Unlock()
+	return qt.current(identity).Bytes >= quota
+}
+
+// accountTraffic accounts bytes transferred by the client against the quota of its identity, notifying and
+// throttling or disconnecting the clients of the identity when the quota is nearly or fully used.
+func (c *Client) accountTraffic(n int) {
+	p := c.Policy()
+	if p.quota == 0 {
+		return
+	}
+	used, event := quotas.Account(p.Identity, n, p.quota)
+	switch event {
+	case quotaNear:
+		logLimit.Info("quota_near", c, "used %d of %d bytes of the traffic quota of the identity", used, p.quota)
+		for _, s := range c.hub.Sessions(p.Identity) {
+			s.sendSpecialFrame(fmt.Sprintf("QUOTA NEAR %d %d", used, p.quota))
+		}
+	case quotaExhausted:
+		logLimit.Warning("quota_exhausted", c, "traffic quota of %d bytes of the identity exhausted", p.quota)
+		atomic.AddUint64(&stats.QuotaExhaustions, 1)
+		for _, s := range c.hub.Sessions(p.Identity) {
+			s.sendSpecialFrame(fmt.Sprintf("QUOTA EXCEEDED %d %d", used, p.quota))
+			if quotaAction == "disconnect" {
+				go s.closeAfterDrain(closePolicyViolation, errQuotaExceeded.Error())
+			} else {
+				s.applyRates(s.Policy())
+			}
+		}
+	}
+
+	// the throttling is lifted when a new period starts
+	if c.isQuotaThrottled() && !quotas.Exceeded(p.Identity, p.quota) {
+		logLimit.Info("quota_restored", c, "traffic quota restored")
+		c.applyRates(p)
+	}
+}
+
+// isQuotaThrottled returns true if the client is limited to the fallback bandwidth because its quota is exceeded.
+func (c *Client) isQuotaThrottled() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.quotaThrottled
+}
+
+// closeAfterDrain closes the client once its pending frames are delivered, or after a second.
+func (c *Client) closeAfterDrain(code int, reason string) {
+	c.drain(time.Now().Add(time.Second))
+	c.Close(code, reason)
+	c.hub.Remove(c)
+}
@@ -18,93 +18,298 @@ with this program; if not, write to the Free Software Foundation, Inc.,
 package main
 
 import (
+	"errors"
+	"fmt"
+	"math"
 	"strconv"
 	"strings"
 	"sync"
 	"time"
 )
 
-func parseBandwidth(s string) (int64, error) {
-	if s == "" {
+// multipliers of the rate units, to bytes per second; unit names are case insensitive
+var rateUnits = map[string]float64{
+	"":      1,
+	"bps":   1,
+	"b/s":   1,
+	"kbps":  1000,
+	"mbps":  1000 * 1000,
+	"gbps":  1000 * 1000 * 1000,
+	"kb/s":  1000,
+	"mb/s":  1000 * 1000,
+	"gb/s":  1000 * 1000 * 1000,
+	"kib/s": 1 << 10,
+	"mib/s": 1 << 20,
+	"gib/s": 1 << 30,
+	"bit":   1.0 / 8,
+	"kbit":  125,
+	"mbit":  1000 * 125,
+	"gbit":  1000 * 1000 * 125,
+}
+
+// multipliers of the size units, to bytes; unit names are case insensitive
+var sizeUnits = map[string]float64{
+	"":     1,
+	"b":    1,
+	"kb":   1000,
+	"mb":   1000 * 1000,
+	"gb":   1000 * 1000 * 1000,
+	"kib":  1 << 10,
+	"mib":  1 << 20,
+	"gib":  1 << 30,
+	"kbit": 125,
+	"mbit": 1000 * 125,
+}
+
+// parseQuota parses a traffic volume, e.g. '500MB' or '1.5GiB'; an empty string means unlimited.
+func parseQuota(s string) (int64, error) {
+	if strings.TrimSpace(s) == "" {
 		return 0, nil
 	}
-	if strings.HasSuffix(s, "kbps") {
-		s = strings.TrimSpace(s[:len(s)-4])
-		n, err := strconv.ParseInt(s, 10, 64)
-		if err != nil {
-			return 0, err
-		}
-		return n * 1000, nil
-	}
-	if strings.HasSuffix(s, "mbps") {
-		s = strings.TrimSpace(s[:len(s)-4])
-		n, err := strconv.ParseInt(s, 10, 64)
-		if err != nil {
-			return 0, err
-		}
-		return n * 1000 * 1000, nil
+	return parseQuantity(s, sizeUnits)
+}
+
+// Bandwidth is a rate limit with its burst size; the zero value means unlimited.
+type Bandwidth struct {
+	// rate in bytes per second
+	rate int64
+	// burst size in bytes, 0 for the default of one second worth of traffic
+	burst int64
+}
+
+// String returns a human-readable description of the bandwidth.
+func (bw Bandwidth) String() string {
+	if bw.rate == 0 {
+		return "unlimited"
 	}
-	if strings.HasSuffix(s, "kbit") {
-		s = strings.TrimSpace(s[:len(s)-4])
-		n, err := strconv.ParseInt(s, 10, 64)
-		if err != nil {
-			return 0, err
-		}
-		return n * 125, nil
+	if bw.burst == 0 {
+		return fmt.Sprintf("%d bytes/s", bw.rate)
 	}
-	if strings.HasSuffix(s, "mbit") {
-		s = strings.TrimSpace(s[:len(s)-4])
-		n, err := strconv.ParseInt(s, 10, 64)
-		if err != nil {
-			return 0, err
-		}
-		return n * 1000 * 125, nil
+	return fmt.Sprintf("%d bytes/s (burst %d bytes)", bw.rate, bw.burst)
+}
+
+// Unlimited returns true if the bandwidth is not limited.
+func (bw Bandwidth) Unlimited() bool {
+	return bw.rate == 0
+}
+
+// parseQuantity parses a decimal number followed by an optional unit, returning the number multiplied by the unit.
+func parseQuantity(s string, units map[string]float64) (int64, error) {
+	s = strings.TrimSpace(s)
+	i := strings.IndexFunc(s, func(r rune) bool { return (r < '0' || r > '9') && r != '.' })
+	if i == -1 {
+		i = len(s)
 	}
-	if strings.HasSuffix(s, "bps") {
-		s = strings.TrimSpace(s[:len(s)-4])
+	if i == 0 {
+		return 0, fmt.Errorf("invalid quantity %q", s)
 	}
-	n, err := strconv.ParseInt(s, 10, 64)
+	n, err := strconv.ParseFloat(s[:i], 64)
 	if err != nil {
 		return 0, err
 	}
-	return n, nil
+	unit := strings.TrimSpace(s[i:])
+	m, ok := units[strings.ToLower(unit)]
+	if !ok {
+		return 0, fmt.Errorf("unknown unit %q", unit)
+	}
+	v := math.Round(n * m)
+	if v > math.MaxInt64 {
+		return 0, errors.New("value out of range")
+	}
+	if v == 0 && n != 0 {
+		// zero means unlimited, which is not what was asked for
+		return 0, fmt.Errorf("quantity %q is too small", s)
+	}
+	return int64(v), nil
+}
+
+// parseBandwidth parses a rate with an optional burst size, e.g. '1.5mbit' or '10MiB/s burst 256KiB'; an empty
+// string means unlimited.
+func parseBandwidth(s string) (Bandwidth, error) {
+	var bw Bandwidth
+	if strings.TrimSpace(s) == "" {
+		return bw, nil
+	}
+	// units are case insensitive, and so is the burst keyword
+	s = strings.ToLower(s)
+	rate, burst := s, ""
+	i := strings.Index(s, "burst")
+	if i != -1 {
+		rate, burst = s[:i], s[i+len("burst"):]
+	}
+
+	var err error
+	bw.rate, err = parseQuantity(rate, rateUnits)
+	if err != nil {
+		return bw, err
+	}
+	if i != -1 {
+		bw.burst, err = parseQuantity(burst, sizeUnits)
+		if err != nil {
+			return bw, fmt.Errorf("burst: %v", err)
+		}
+		if bw.burst == 0 {
+			return bw, errors.New("burst must be positive")
+		}
+	}
+	return bw, nil
 }
 
-/* BandwidthAllowance is a simple rate-limiting device.
-Bandwidths or rates can be specified in:
-* kbps - Kilobytes per second
-* mbps - Megabytes per second
-* kbit - Kilobits per second
-* mbit - Megabits per second
-* bps or a bare number - Bytes per second */
+// BandwidthAllowance is a token bucket rate-limiting device: tokens, i.e. bytes, accumulate at the configured rate
+// up to the burst size and each frame consumes as many tokens as its size.
+// Frames exceeding the allowance can either be dropped (DoThrottle) or delayed until they conform (Reserve).
 type BandwidthAllowance struct {
 	sync.Mutex
-	lastCheck       time.Time
-	allowance, rate int64
+	// clock returns the current time; time.Now when nil
+	clock     func() time.Time
+	lastCheck time.Time
+	tokens    float64
+	bandwidth Bandwidth
+	burst     float64
 }
 
-// DoThrottle returns true if the payload of specified size needs to be throttled (dropped).
-func (ba BandwidthAllowance) DoThrottle(size int) bool {
-	if ba.rate == 0 {
-		return false
+// now returns the current time according to the allowance clock.
+func (ba *BandwidthAllowance) now() time.Time {
+	if ba.clock != nil {
+		return ba.clock()
 	}
+	return time.Now()
+}
+
+// SetRate changes the bandwidth of the allowance, which can happen concurrently with its use; a zero bandwidth disables
+// rate limiting. Tokens accumulated at the previous rate are kept up to the new burst size, so that lowering the rate
+// takes effect immediately; the bucket is filled only when rate limiting was disabled.
+func (ba *BandwidthAllowance) SetRate(bw Bandwidth) {
 	ba.Lock()
-	now := time.Now()
-	timePassed := now.Sub(ba.lastCheck)
+	defer ba.Unlock()
+	if bw == ba.bandwidth {
+		return
+	}
+	wasUnlimited := ba.bandwidth.rate == 0
+	if !wasUnlimited {
+		ba.refill()
+	}
+	ba.bandwidth = bw
+	ba.burst = float64(bw.burst)
+	if bw.burst == 0 {
+		ba.burst = float64(bw.rate)
+	}
+	if wasUnlimited || ba.tokens > ba.burst {
+		ba.tokens = ba.burst
+	}
+	ba.lastCheck = ba.now()
+}
+
+// Bandwidth returns the current bandwidth of the allowance.
+func (ba *BandwidthAllowance) Bandwidth() Bandwidth {
+	ba.Lock()
+	defer ba.Unlock()
+	return ba.bandwidth
+}
 
+// refill adds the tokens accumulated since the last check; allowance must be locked by the caller.
+func (ba *BandwidthAllowance) refill() {
+	now := ba.now()
+	ba.tokens += now.Sub(ba.lastCheck).Seconds() * float64(ba.bandwidth.rate)
+	if ba.tokens > ba.burst {
+		ba.tokens = ba.burst
+	}
 	ba.lastCheck = now
-	ba.allowance += int64(timePassed.Seconds() * float64(ba.rate))
+}
 
-	if ba.allowance > ba.rate {
-		ba.allowance = ba.rate // throttle
+// needed returns the tokens which must be available for a frame of the specified size to conform; frames bigger
+// than the burst size conform when the bucket is full.
+func (ba *BandwidthAllowance) needed(size int) float64 {
+	return math.Min(float64(size), ba.burst)
+}
+
+// wait returns the time after which the payload of specified size conforms to the allowance; allowance must be
+// locked by the caller.
+func (ba *BandwidthAllowance) wait(size int) time.Duration {
+	if ba.bandwidth.rate == 0 {
+		return 0
+	}
+	ba.refill()
+	missing := ba.needed(size) - ba.tokens
+	if missing <= 0 {
+		return 0
 	}
+	return time.Duration(missing / float64(ba.bandwidth.rate) * float64(time.Second))
+}
 
-	if ba.allowance > 1.0 {
-		ba.allowance -= int64(size)
-		ba.Unlock()
+// DoThrottle returns true if the payload of specified size needs to be throttled (dropped); otherwise the payload
+// is accounted for.
+func (ba *BandwidthAllowance) DoThrottle(size int) bool {
+	ba.Lock()
+	defer ba.Unlock()
+	if ba.wait(size) > 0 {
 		return true
 	}
+	ba.consumeLocked(size)
+	return false
+}
+
+// Reserve accounts for the payload of specified size and returns the delay after which it conforms to the allowance;
+// if the delay would exceed maxDelay nothing is accounted and false is returned, meaning that the payload should be dropped.
+func (ba *BandwidthAllowance) Reserve(size int, maxDelay time.Duration) (time.Duration, bool) {
+	ba.Lock()
+	defer ba.Unlock()
+	delay := ba.wait(size)
+	if delay > maxDelay {
+		return 0, false
+	}
+	ba.consumeLocked(size)
+	return delay, true
+}
 
+// consumeLocked accounts for a payload; tokens of delayed payloads are borrowed from the future. Allowance must be
+// locked by the caller.
+func (ba *BandwidthAllowance) consumeLocked(size int) {
+	if ba.bandwidth.rate != 0 {
+		ba.tokens -= float64(size)
+	}
+}
+
+// delay returns the time after which the payload of specified size conforms to the allowance, without accounting
+// for it.
+func (ba *BandwidthAllowance) delay(size int) time.Duration {
+	ba.Lock()
+	defer ba.Unlock()
+	return ba.wait(size)
+}
+
+// consume accounts for the payload of specified size.
+func (ba *BandwidthAllowance) consume(size int) {
+	ba.Lock()
+	ba.consumeLocked(size)
 	ba.Unlock()
-	return false
+}
+
+// spare returns true if the bucket is at least half full.
+func (ba *BandwidthAllowance) spare() bool {
+	ba.Lock()
+	defer ba.Unlock()
+	if ba.bandwidth.rate == 0 {
+		return true
+	}
+	ba.refill()
+	return ba.tokens >= ba.burst/2
+}
+
+// full returns true if the bucket is full, i.e. the allowance is in the same state as a new one.
+func (ba *BandwidthAllowance) full() bool {
+	ba.Lock()
+	defer ba.Unlock()
+	if ba.bandwidth.rate == 0 {
+		return true
+	}
+	ba.refill()
+	return ba.tokens >= ba.burst
+}
+
+// limits returns the rate in bytes per second and the burst size in bytes of the allowance.
+func (ba *BandwidthAllowance) limits() (rate, burst float64) {
+	ba.Lock()
+	defer ba.Unlock()
+	return float64(ba.bandwidth.rate), ba.burst
 }
@@ -0,0 +1,214 @@
+/* go-websockproxy - https://github.com/gdm85/go-websockproxy
+Copyright (C) 2016 gdm85
+
+This program is free software; you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation; either version 2 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License along
+with this program; if not, write to the Free Software Foundation, Inc.,
+51 Franklin Street, Fifth Floor, Boston, MA 02110-1301 USA.
+*/
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+// fakeClock is a clock which moves only when told to.
+type fakeClock struct {
+	now time.Time
+}
+
+func (fc *fakeClock) Now() time.Time {
+	return fc.now
+}
+
+func (fc *fakeClock) Advance(d time.Duration) {
+	fc.now = fc.now.Add(d)
+}
+
+// newTestAllowance returns an allowance with the specified bandwidth, driven by a fake clock.
+func newTestAllowance(bw Bandwidth) (*BandwidthAllowance, *fakeClock) {
+	fc := &fakeClock{now: time.Unix(1000, 0)}
+	ba := &BandwidthAllowance{clock: fc.Now}
+	ba.SetRate(bw)
+	return ba, fc
+}
+
+func TestParseBandwidth(t *testing.T) {
+	tests := []struct {
+		spec string
+		want Bandwidth
+	}{
+		{"", Bandwidth{}},
+		{"0", Bandwidth{}},
+		{"1000", Bandwidth{rate: 1000}},
+		{"50kbps", Bandwidth{rate: 50000}},
+		{"1.5mbit", Bandwidth{rate: 187500}},
+		{"2Gbit", Bandwidth{rate: 250000000}},
+		{"10KiB/s", Bandwidth{rate: 10240}},
+		{"0.5 MB/s", Bandwidth{rate: 500000}},
+		{"10MiB/s burst 256KiB", Bandwidth{rate: 10 << 20, burst: 256 << 10}},
+		{"10Mbit Burst 1MiB", Bandwidth{rate: 1250000, burst: 1 << 20}},
+		{"1mbit burst 1500", Bandwidth{rate: 125000, burst: 1500}},
+	}
+	for _, test := range tests {
+		got, err := parseBandwidth(test.spec)
+		if err != nil {
+			t.Errorf("parseBandwidth(%q): unexpected error: %v", test.spec, err)
+			continue
+		}
+		if got != test.want {
+			t.Errorf("parseBandwidth(%q) = %+v, want %+v", test.spec, got, test.want)
+		}
+	}
+}
+
+func TestParseBandwidthInvalid(t *testing.T) {
+	for _, spec := range []string{
+		"fast",
+		"-5kbps",
+		"10 furlongs",
+		"1.2.3mbit",
+		"1bit",
+		"0.4",
+		"10mbit burst",
+		"10mbit burst 0",
+		"10mbit burst 1 parsec",
+	} {
+		if bw, err := parseBandwidth(spec); err == nil {
+			t.Errorf("parseBandwidth(%q) = %+v, want error", spec, bw)
+		}
+	}
+}
+
+func TestAllowanceBurst(t *testing.T) {
+	ba, _ := newTestAllowance(Bandwidth{rate: 1000, burst: 3000})
+	for i := 0; i < 3; i++ {
+		if ba.DoThrottle(1000) {
+			t.Fatalf("frame %d throttled within the burst size", i)
+		}
+	}
+	if !ba.DoThrottle(1) {
+		t.Fatal("frame beyond the burst size not throttled")
+	}
+}
+
+func TestAllowanceRefill(t *testing.T) {
+	ba, fc := newTestAllowance(Bandwidth{rate: 1000})
+	if ba.DoThrottle(1000) {
+		t.Fatal("first frame throttled")
+	}
+	if !ba.DoThrottle(1) {
+		t.Fatal("frame throttled with an empty bucket")
+	}
+
+	fc.Advance(500 * time.Millisecond)
+	if ba.DoThrottle(500) {
+		t.Fatal("frame throttled after refill")
+	}
+	if !ba.DoThrottle(1) {
+		t.Fatal("frame not throttled after consuming the refill")
+	}
+
+	// tokens do not accumulate beyond the burst size
+	fc.Advance(10 * time.Second)
+	if ba.DoThrottle(1000) {
+		t.Fatal("frame throttled with a full bucket")
+	}
+	if !ba.DoThrottle(1) {
+		t.Fatal("bucket filled beyond the burst size")
+	}
+}
+
+func TestAllowanceUnlimited(t *testing.T) {
+	var ba BandwidthAllowance
+	for i := 0; i < 100; i++ {
+		if ba.DoThrottle(1 << 20) {
+			t.Fatal("unlimited allowance throttled")
+		}
+	}
+	if delay, ok := ba.Reserve(1<<20, 0); !ok || delay != 0 {
+		t.Fatalf("Reserve = %v, %v on unlimited allowance", delay, ok)
+	}
+}
+
+func TestAllowanceReserve(t *testing.T) {
+	ba, fc := newTestAllowance(Bandwidth{rate: 1000})
+	if delay, ok := ba.Reserve(1000, time.Second); !ok || delay != 0 {
+		t.Fatalf("Reserve with full bucket = %v, %v", delay, ok)
+	}
+	// tokens are borrowed from the future
+	if delay, ok := ba.Reserve(500, time.Second); !ok || delay != 500*time.Millisecond {
+		t.Fatalf("Reserve = %v, %v, want 500ms", delay, ok)
+	}
+	// 500 borrowed tokens plus 1000 needed exceed the max delay: nothing is accounted
+	if _, ok := ba.Reserve(1000, time.Second); ok {
+		t.Fatal("Reserve beyond the max delay succeeded")
+	}
+	if delay, ok := ba.Reserve(100, time.Second); !ok || delay != 600*time.Millisecond {
+		t.Fatalf("Reserve = %v, %v, want 600ms", delay, ok)
+	}
+
+	fc.Advance(600 * time.Millisecond)
+	if delay, ok := ba.Reserve(0, time.Second); !ok || delay != 0 {
+		t.Fatalf("Reserve after the delay = %v, %v", delay, ok)
+	}
+}
+
+func TestAllowanceReserveLargeFrame(t *testing.T) {
+	ba, _ := newTestAllowance(Bandwidth{rate: 1000})
+	// frames bigger than the burst size conform when the bucket is full
+	if delay, ok := ba.Reserve(5000, 0); !ok || delay != 0 {
+		t.Fatalf("Reserve of large frame = %v, %v", delay, ok)
+	}
+	if !ba.DoThrottle(1000) {
+		t.Fatal("large frame not accounted")
+	}
+}
+
+func TestAllowanceSetRateLowering(t *testing.T) {
+	ba, _ := newTestAllowance(Bandwidth{rate: 10000})
+	ba.SetRate(Bandwidth{rate: 1000})
+	if ba.DoThrottle(1000) {
+		t.Fatal("frame throttled within the new burst size")
+	}
+	if !ba.DoThrottle(1) {
+		t.Fatal("tokens not capped to the new burst size")
+	}
+}
+
+func TestAllowanceSetRateRaising(t *testing.T) {
+	ba, fc := newTestAllowance(Bandwidth{rate: 1000})
+	ba.DoThrottle(1000)
+	ba.SetRate(Bandwidth{rate: 10000})
+	// raising the rate does not refill the bucket, but it refills faster
+	if !ba.DoThrottle(1) {
+		t.Fatal("bucket refilled by raising the rate")
+	}
+	fc.Advance(100 * time.Millisecond)
+	if ba.DoThrottle(1000) {
+		t.Fatal("frame throttled after refill at the new rate")
+	}
+	if got := ba.Bandwidth(); got != (Bandwidth{rate: 10000}) {
+		t.Fatalf("Bandwidth() = %+v", got)
+	}
+}
+
+func TestAllowanceSetRateFromUnlimited(t *testing.T) {
+	var ba BandwidthAllowance
+	fc := &fakeClock{now: time.Unix(1000, 0)}
+	ba.clock = fc.Now
+	ba.SetRate(Bandwidth{rate: 1000, burst: 2000})
+	if ba.DoThrottle(2000) {
+		t.Fatal("bucket not filled when enabling rate limiting")
+	}
+}
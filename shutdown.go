@@ -0,0 +1,136 @@
+/* go-websockproxy - https://github.com/gdm85/go-websockproxy
+Copyright (C) 2016 gdm85
+
+This program is free software; you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation; either version 2 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License along
+with this program; if not, write to the Free Software Foundation, Inc.,
+51 Franklin Street, Fifth Floor, Boston, MA 02110-1301 USA.
+*/
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"net/http"
+	"os/exec"
+	"sync"
+	"time"
+
+	"golang.org/x/net/websocket"
+)
+
+// websocket close codes, see RFC 6455 section 7.4.1
+const (
+	closeNormal          = 1000
+	closeGoingAway       = 1001
+	closePolicyViolation = 1008
+	closeTryAgainLater   = 1013
+
+	// maximum length of a close reason, so that the close frame payload fits in a control frame
+	maxCloseReasonLength = 123
+)
+
+// closeMessage is the payload of a websocket close frame.
+type closeMessage struct {
+	code   int
+	reason string
+}
+
+// closeCodec sends websocket close frames carrying a close code and a reason, which golang.org/x/net/websocket does not support.
+var closeCodec = websocket.Codec{Marshal: marshalClose}
+
+func marshalClose(v interface{}) ([]byte, byte, error) {
+	m := v.(closeMessage)
+	reason := m.reason
+	if len(reason) > maxCloseReasonLength {
+		reason = reason[:maxCloseReasonLength]
+	}
+	payload := make([]byte, 2+len(reason))
+	binary.BigEndian.PutUint16(payload, uint16(m.code))
+	copy(payload[2:], reason)
+	return payload, websocket.CloseFrame, nil
+}
+
+// closeWebsocket sends a close frame with the specified code and reason, then interrupts any pending read on the connection
+// so that its handler can return and release it.
+func closeWebsocket(ws *websocket.Conn, code int, reason string) {
+	// do not let an unresponsive peer hold the close frame forever
+	ws.SetWriteDeadline(time.Now().Add(time.Second))
+	err := closeCodec.Send(ws, closeMessage{code: code, reason: reason})
+	if err != nil {
+		logConn.Debug("close_frame_failed", nil, "sending close frame to %s: %v", ws.Request().RemoteAddr, err)
+	}
+	ws.SetReadDeadline(time.Now())
+}
+
+// Close terminates the delivery of frames to the client and closes its websocket connection with the specified code and reason.
+func (c *Client) Close(code int, reason string) {
+	c.terminate()
+	closeWebsocket(c.ws, code, reason)
+	logConn.Debug("client_closed", c, "closed with code %d (%s)", code, reason)
+}
+
+// drain waits until all frames queued for the client have been delivered or the deadline is reached.
+func (c *Client) drain(deadline time.Time) {
+	t := time.NewTimer(time.Until(deadline))
+	defer t.Stop()
+	select {
+	case <-c.frames.Drained():
+	case <-c.terminator:
+	case <-t.C:
+	}
+	if n := c.frames.Len(); n != 0 {
+		logSwitch.Warning("frames_not_delivered", c, "%d frames not delivered before the deadline", n)
+	}
+}
+
+// shutdown gracefully stops the servers: no new connections are accepted, pending frames are delivered to clients
+// until the shutdown timeout expires, websockets are closed and the TAP interface is torn down.
+func shutdown(servers []*http.Server) {
+	deadline := time.Now().Add(shutdownTimeout)
+	ctx, cancel := context.WithDeadline(context.Background(), deadline)
+	defer cancel()
+
+	var wg sync.WaitGroup
+	for _, server := range servers {
+		wg.Add(1)
+		go func(server *http.Server) {
+			defer wg.Done()
+			// stop listening; hijacked websocket connections are not affected and are closed by the hub
+			if err := server.Shutdown(ctx); err != nil {
+				logMain.Warning("http_shutdown_failed", nil, "shutting down HTTP server on %s: %v", server.Addr, err)
+			}
+		}(server)
+	}
+	hub.Shutdown(deadline, "server shutting down")
+	wg.Wait()
+	quotas.Save()
+
+	teardownTAP()
+}
+
+// teardownTAP brings down and releases the TAP interface created at startup; the kernel destroys a non-persistent
+// TAP interface once its last file descriptor is closed.
+func teardownTAP() {
+	if tap == nil {
+		return
+	}
+	name := tap.Name()
+	if err := exec.Command("ip", "link", "set", name, "down").Run(); err != nil {
+		logSwitch.Warning("tap_down_failed", nil, "bringing TAP interface down: %v", err)
+	}
+	if err := tap.Close(); err != nil {
+		logSwitch.Warning("tap_close_failed", nil, "closing TAP interface: %v", err)
+		return
+	}
+	logSwitch.Info("tap_removed", nil, "device %s removed", name)
+}
@@ -0,0 +1,123 @@
+/* go-websockproxy - https://github.com/gdm85/go-websockproxy
+Copyright (C) 2016 gdm85
+
+This program is free software; you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation; either version 2 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License along
+with this program; if not, write to the Free Software Foundation, Inc.,
+51 Franklin Street, Fifth Floor, Boston, MA 02110-1301 USA.
+*/
+package main
+
+import (
+	"fmt"
+	"io"
+	"sync/atomic"
+)
+
+// Stats holds counters of the events relevant to operators; counters must be updated atomically.
+type Stats struct {
+	QueueOverflows           uint64
+	WriteTimeouts            uint64
+	SlowConsumerEvictions    uint64
+	SlowConsumerDegradations uint64
+	DegradedDrops            uint64
+	MemoryBudgetDrops        uint64
+	MemoryBudgetReclaims     uint64
+	AuthTimeouts             uint64
+	UnauthorizedLimitCloses  uint64
+	PacketRateDrops          uint64
+	BroadcastDrops           uint64
+	StormQuarantines         uint64
+	QuarantineDrops          uint64
+	QuotaExhaustions         uint64
+	UplinkDrops              uint64
+	ImpairmentDrops          uint64
+	ImpairmentDuplicates     uint64
+	BackpressurePauses       uint64
+	ClientPauses             uint64
+	TooShortDrops            uint64
+	UnauthorizedDrops        uint64
+	FlaggedDrops             uint64
+	SpoofedMACDrops          uint64
+	TaggedDrops              uint64
+	UploadRateLimitDrops     uint64
+	DownloadRateLimitDrops   uint64
+	TAPReadErrors            uint64
+	TAPWriteErrors           uint64
+	HandshakesAccepted       uint64
+	HandshakesBanned         uint64
+	HandshakesLimited        uint64
+	HandshakesOriginRejected uint64
+	HandshakesUnauthorized   uint64
+	HandshakesUnavailable    uint64
+}
+
+var stats Stats
+
+// counter is a named reference to one of the counters.
+type counter struct {
+	name  string
+	value *uint64
+}
+
+// counters returns all counters, in display order.
+func (s *Stats) counters() []counter {
+	return []counter{
+		{"queue_overflows", &s.QueueOverflows},
+		{"write_timeouts", &s.WriteTimeouts},
+		{"slow_consumer_evictions", &s.SlowConsumerEvictions},
+		{"slow_consumer_degradations", &s.SlowConsumerDegradations},
+		{"degraded_drops", &s.DegradedDrops},
+		{"memory_budget_drops", &s.MemoryBudgetDrops},
+		{"memory_budget_reclaims", &s.MemoryBudgetReclaims},
+		{"auth_timeouts", &s.AuthTimeouts},
+		{"unauthorized_limit_closes", &s.UnauthorizedLimitCloses},
+		{"packet_rate_drops", &s.PacketRateDrops},
+		{"broadcast_drops", &s.BroadcastDrops},
+		{"storm_quarantines", &s.StormQuarantines},
+		{"quarantine_drops", &s.QuarantineDrops},
+		{"quota_exhaustions", &s.QuotaExhaustions},
+		{"uplink_drops", &s.UplinkDrops},
+		{"impairment_drops", &s.ImpairmentDrops},
+		{"impairment_duplicates", &s.ImpairmentDuplicates},
+		{"backpressure_pauses", &s.BackpressurePauses},
+		{"client_pauses", &s.ClientPauses},
+		{"too_short_drops", &s.TooShortDrops},
+		{"unauthorized_drops", &s.UnauthorizedDrops},
+		{"flagged_drops", &s.FlaggedDrops},
+		{"spoofed_mac_drops", &s.SpoofedMACDrops},
+		{"tagged_drops", &s.TaggedDrops},
+		{"upload_rate_limit_drops", &s.UploadRateLimitDrops},
+		{"download_rate_limit_drops", &s.DownloadRateLimitDrops},
+		{"tap_read_errors", &s.TAPReadErrors},
+		{"tap_write_errors", &s.TAPWriteErrors},
+		{"handshakes_accepted", &s.HandshakesAccepted},
+		{"handshakes_banned", &s.HandshakesBanned},
+		{"handshakes_limited", &s.HandshakesLimited},
+		{"handshakes_origin_rejected", &s.HandshakesOriginRejected},
+		{"handshakes_unauthorized", &s.HandshakesUnauthorized},
+		{"handshakes_unavailable", &s.HandshakesUnavailable},
+	}
+}
+
+// WriteTo writes all counters in the form 'name value', one per line.
+func (s *Stats) WriteTo(w io.Writer) (int64, error) {
+	var total int64
+	for _, c := range s.counters() {
+		n, err := fmt.Fprintf(w, "%s %d\n", c.name, atomic.LoadUint64(c.value))
+		total += int64(n)
+		if err != nil {
+			return total, err
+		}
+	}
+	return total, nil
+}
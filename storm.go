@@ -0,0 +1,79 @@
+/* go-websockproxy - https://github.com/gdm85/go-websockproxy
+Copyright (C) 2016 gdm85
+
+This program is free software; you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation; either version 2 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License along
+with this program; if not, write to the Free Software Foundation, Inc.,
+51 Franklin Street, Fifth Floor, Boston, MA 02110-1301 USA.
+*/
+package main
+
+import (
+	"sync/atomic"
+	"time"
+
+	"github.com/songgao/water/waterutil"
+)
+
+// stormWindow is the period over which the frames dropped by the packet rate limits of a client are counted
+// against the storm threshold
+const stormWindow = time.Second
+
+// stormControl holds the packet rate limits of the frames uploaded by a client; it is accessed only by the goroutine
+// reading from the client.
+type stormControl struct {
+	packets, broadcasts BandwidthAllowance
+	drops               int
+	windowStart         time.Time
+	quarantinedUntil    time.Time
+}
+
+// isGroupAddress returns true if the MAC address is a broadcast or multicast address.
+func isGroupAddress(frame []byte) bool {
+	dst := waterutil.MACDestination(frame)
+	return waterutil.IsBroadcast(dst) || dst[0]&1 == 1
+}
+
+// AdmitUpload returns true if a frame uploaded by the client is within its packet rate limits and the client is not
+// quarantined; a client dropping more than the storm threshold of frames in a second is quarantined.
+func (c *Client) AdmitUpload(frame []byte) bool {
+	sc := &c.storm
+	now := time.Now()
+	if now.Before(sc.quarantinedUntil) {
+		atomic.AddUint64(&stats.QuarantineDrops, 1)
+		return false
+	}
+
+	if sc.packets.DoThrottle(1) {
+		atomic.AddUint64(&stats.PacketRateDrops, 1)
+	} else if isGroupAddress(frame) && sc.broadcasts.DoThrottle(1) {
+		atomic.AddUint64(&stats.BroadcastDrops, 1)
+	} else {
+		return true
+	}
+
+	if stormThreshold == 0 {
+		return false
+	}
+	if now.Sub(sc.windowStart) > stormWindow {
+		sc.windowStart = now
+		sc.drops = 0
+	}
+	sc.drops++
+	if sc.drops > stormThreshold {
+		sc.quarantinedUntil = now.Add(stormQuarantine)
+		sc.drops = 0
+		atomic.AddUint64(&stats.StormQuarantines, 1)
+		logLimit.Warning("client_quarantined", c, "quarantined for %v after exceeding the storm threshold", stormQuarantine)
+	}
+	return false
+}
@@ -0,0 +1,193 @@
+/* go-websockproxy - https://github.com/gdm85/go-websockproxy
+Copyright (C) 2016 gdm85
+
+This program is free software; you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation; either version 2 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License along
+with this program; if not, write to the Free Software Foundation, Inc.,
+51 Franklin Street, Fifth Floor, Boston, MA 02110-1301 USA.
+*/
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	flag "github.com/ogier/pflag"
+)
+
+// Tokens are made of the base64url-encoded JSON claims and of the base64url-encoded HMAC-SHA256 of the encoded
+// claims keyed with the token secret, separated by a dot.
+
+// TokenClaims are the claims of an access token.
+type TokenClaims struct {
+	Subject              string `json:"sub"`
+	Expires              int64  `json:"exp"`
+	NotBefore            int64  `json:"nbf,omitempty"`
+	VLAN                 int    `json:"vlan,omitempty"`
+	MACPrefix            string `json:"mac-prefix,omitempty"`
+	MaxUploadBandwidth   string `json:"max-upload-bandwidth,omitempty"`
+	MaxDownloadBandwidth string `json:"max-download-bandwidth,omitempty"`
+}
+
+var (
+	errTokensDisabled   = errors.New("access tokens are not enabled")
+	errInvalidToken     = errors.New("invalid access token")
+	errTokenExpired     = errors.New("access token expired")
+	errTokenNotYetValid = errors.New("access token not yet valid")
+)
+
+// isToken returns true if the credential has the structure of an access token: base64-encoded JSON claims and a
+// base64-encoded SHA-256 signature, separated by a dot. Keys can contain dots, thus the format alone is not enough.
+func isToken(credential string) bool {
+	i := strings.IndexByte(credential, '.')
+	if i == -1 {
+		return false
+	}
+	claims, err := base64.RawURLEncoding.DecodeString(credential[:i])
+	if err != nil || len(claims) == 0 || claims[0] != '{' || !json.Valid(claims) {
+		return false
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(credential[i+1:])
+	return err == nil && len(signature) == sha256.Size
+}
+
+// tokenSignature returns the signature of the encoded claims.
+func tokenSignature(secret, encodedClaims string) []byte {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(encodedClaims))
+	return mac.Sum(nil)
+}
+
+// mintToken returns an access token with the specified claims, signed with the secret.
+func mintToken(secret string, claims *TokenClaims) (string, error) {
+	data, err := json.Marshal(claims)
+	if err != nil {
+		return "", err
+	}
+	encodedClaims := base64.RawURLEncoding.EncodeToString(data)
+	return encodedClaims + "." + base64.RawURLEncoding.EncodeToString(tokenSignature(secret, encodedClaims)), nil
+}
+
+// verifyToken verifies the signature and validity period of an access token and returns the policy mapped from its claims.
+func (cfg *Config) verifyToken(token string, now time.Time) (*Policy, error) {
+	if cfg.TokenSecret == "" {
+		return nil, errTokensDisabled
+	}
+	parts := strings.Split(token, ".")
+	if len(parts) != 2 {
+		return nil, errInvalidToken
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil || !hmac.Equal(signature, tokenSignature(cfg.TokenSecret, parts[0])) {
+		return nil, errInvalidToken
+	}
+	data, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil {
+		return nil, errInvalidToken
+	}
+	var claims TokenClaims
+	if err := json.Unmarshal(data, &claims); err != nil {
+		return nil, errInvalidToken
+	}
+
+	if claims.Subject == "" || claims.Expires == 0 {
+		return nil, fmt.Errorf("%v: subject and expiry are mandatory", errInvalidToken)
+	}
+	expires := time.Unix(claims.Expires, 0)
+	if !now.Before(expires) {
+		return nil, errTokenExpired
+	}
+	if claims.NotBefore != 0 && now.Before(time.Unix(claims.NotBefore, 0)) {
+		return nil, errTokenNotYetValid
+	}
+
+	p, err := cfg.newPolicy(&KeyEntry{
+		Identity:             claims.Subject,
+		Key:                  token,
+		VLAN:                 claims.VLAN,
+		MACPrefix:            claims.MACPrefix,
+		MaxUploadBandwidth:   claims.MaxUploadBandwidth,
+		MaxDownloadBandwidth: claims.MaxDownloadBandwidth,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("%v: %v", errInvalidToken, err)
+	}
+	p.Expires = expires
+	p.credential = credentialToken
+	return p, nil
+}
+
+// authorizeToken authorizes the client with an access token; it returns true if the client should be put in the idle loop.
+func (c *Client) authorizeToken(token string) (bool, error) {
+	policy, err := c.hub.Config().verifyToken(token, time.Now())
+	if err != nil {
+		return err != errTokensDisabled, err
+	}
+	return c.authorize(policy)
+}
+
+// mintTokenCommand implements the 'mint-token' subcommand, which prints an access token for testing.
+func mintTokenCommand(args []string) {
+	var (
+		secret, subject, macPrefix, maxUpload, maxDownload string
+		ttl, notBefore                                     time.Duration
+		vlan                                               int
+	)
+	fs := flag.NewFlagSet("mint-token", flag.ExitOnError)
+	fs.StringVar(&secret, "token-secret", "", "secret used to sign the token (mandatory)")
+	fs.StringVar(&subject, "subject", "", "identity of the token holder (mandatory)")
+	fs.DurationVar(&ttl, "ttl", time.Hour, "validity of the token")
+	fs.DurationVar(&notBefore, "not-before", 0, "delay after which the token becomes valid")
+	fs.IntVar(&vlan, "vlan", 0, "virtual network of the client; 0 for the default network")
+	fs.StringVar(&macPrefix, "mac-prefix", "", "MAC prefix the client must use")
+	fs.StringVar(&maxUpload, "max-upload-bandwidth", "", "max upload bandwidth of the client")
+	fs.StringVar(&maxDownload, "max-download-bandwidth", "", "max download bandwidth of the client")
+	fs.Parse(args)
+
+	if secret == "" || subject == "" {
+		logMain.Error("invalid_option", nil, "both token secret and subject must be specified")
+		os.Exit(1)
+	}
+
+	for _, bandwidth := range []string{maxUpload, maxDownload} {
+		if _, err := parseBandwidth(bandwidth); err != nil {
+			logMain.Error("invalid_option", nil, "invalid bandwidth specified: %v", err)
+			os.Exit(1)
+		}
+	}
+
+	now := time.Now()
+	claims := &TokenClaims{
+		Subject:              subject,
+		Expires:              now.Add(notBefore + ttl).Unix(),
+		VLAN:                 vlan,
+		MACPrefix:            macPrefix,
+		MaxUploadBandwidth:   maxUpload,
+		MaxDownloadBandwidth: maxDownload,
+	}
+	if notBefore != 0 {
+		claims.NotBefore = now.Add(notBefore).Unix()
+	}
+	token, err := mintToken(secret, claims)
+	if err != nil {
+		logMain.Error("mint_token_failed", nil, "minting token: %v", err)
+		os.Exit(1)
+	}
+	fmt.Println(token)
+}
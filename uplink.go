@@ -0,0 +1,191 @@
+/* go-websockproxy - https://github.com/gdm85/go-websockproxy
+Copyright (C) 2016 gdm85
+
+This program is free software; you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation; either version 2 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License along
+with this program; if not, write to the Free Software Foundation, Inc.,
+51 Franklin Street, Fifth Floor, Boston, MA 02110-1301 USA.
+*/
+package main
+
+import (
+	"sync"
+	"sync/atomic"
+)
+
+// uplinkQuantum is the number of bytes a client with weight 1 can write to the TAP interface in each round,
+// the size of a full ethernet frame
+const uplinkQuantum = 1514
+
+// uplinkFrame is a frame waiting to be written to the TAP interface.
+type uplinkFrame struct {
+	vlan  int
+	frame []byte
+}
+
+// uplinkQueue is the queue of the frames of a client waiting to be written to the TAP interface.
+type uplinkQueue struct {
+	frames  []uplinkFrame
+	weight  int
+	deficit int
+	// visited is true when the queue already received its quantum in the current round
+	visited bool
+	active  bool
+}
+
+// UplinkWriter writes the frames of the clients to the TAP interface, scheduling them with deficit round robin:
+// each client with pending frames can write up to its weight times the quantum in each round, so that a heavy
+// uploader cannot starve the other clients.
+type UplinkWriter struct {
+	sync.Mutex
+	queues  map[RateLimiter]*uplinkQueue
+	active  []*uplinkQueue
+	current int
+	ready   chan struct{}
+}
+
+var uplink = newUplinkWriter()
+
+// newUplinkWriter returns an uplink writer; its scheduling loop must be started with run.
+func newUplinkWriter() *UplinkWriter {
+	return &UplinkWriter{
+		queues: map[RateLimiter]*uplinkQueue{},
+		ready:  make(chan struct{}, 1),
+	}
+}
+
+// weighted is implemented by the sources of frames which have an uplink weight.
+type weighted interface {
+	UplinkWeight() int
+}
+
+// Enqueue queues a frame of the source for writing to the TAP interface; it returns false if the frame was dropped
+// because the queue of the source is full.
+func (u *UplinkWriter) Enqueue(source RateLimiter, vlan int, frame []byte) bool {
+	weight := 1
+	if w, ok := source.(weighted); ok {
+		weight = w.UplinkWeight()
+	}
+
+	u.Lock()
+	q, ok := u.queues[source]
+	if !ok {
+		q = &uplinkQueue{}
+		u.queues[source] = q
+	}
+	q.weight = weight
+	if len(q.frames) >= uplinkQueueLength {
+		u.Unlock()
+		atomic.AddUint64(&stats.UplinkDrops, 1)
+		return false
+	}
+	q.frames = append(q.frames, uplinkFrame{vlan, frame})
+	if !q.active {
+		q.active = true
+		u.active = append(u.active, q)
+	}
+	u.Unlock()
+
+	select {
+	case u.ready <- struct{}{}:
+	default:
+	}
+	return true
+}
+
+// Len returns the number of frames waiting to be written.
+func (u *UplinkWriter) Len() int {
+	u.Lock()
+	defer u.Unlock()
+	var n int
+	for _, q := range u.queues {
+		n += len(q.frames)
+	}
+	return n
+}
+
+// Remove discards the queue of a source.
+func (u *UplinkWriter) Remove(source RateLimiter) {
+	u.Lock()
+	defer u.Unlock()
+	q, ok := u.queues[source]
+	if !ok {
+		return
+	}
+	delete(u.queues, source)
+	for i, aq := range u.active {
+		if aq == q {
+			u.deactivate(i)
+			break
+		}
+	}
+}
+
+// deactivate removes the queue at the specified position from the active queues; writer must be locked by the caller.
+func (u *UplinkWriter) deactivate(i int) {
+	q := u.active[i]
+	q.active, q.visited, q.deficit = false, false, 0
+	u.active = append(u.active[:i], u.active[i+1:]...)
+	if i < u.current {
+		u.current--
+	}
+	if u.current >= len(u.active) {
+		u.current = 0
+	}
+}
+
+// next returns the next frame to write according to the scheduling, or false if no frame is pending.
+func (u *UplinkWriter) next() (uplinkFrame, bool) {
+	u.Lock()
+	defer u.Unlock()
+	for len(u.active) != 0 {
+		q := u.active[u.current]
+		if len(q.frames) == 0 {
+			u.deactivate(u.current)
+			continue
+		}
+		if !q.visited {
+			q.deficit += uplinkQuantum * q.weight
+			q.visited = true
+		}
+		f := q.frames[0]
+		if len(f.frame) <= q.deficit {
+			q.frames[0] = uplinkFrame{}
+			q.frames = q.frames[1:]
+			q.deficit -= len(f.frame)
+			if len(q.frames) == 0 {
+				u.deactivate(u.current)
+			}
+			return f, true
+		}
+		// the quantum of this queue is used up, move to the next one
+		q.visited = false
+		u.current = (u.current + 1) % len(u.active)
+	}
+	return uplinkFrame{}, false
+}
+
+// run writes the queued frames to the TAP interface, forever.
+func (u *UplinkWriter) run() {
+	for range u.ready {
+		for {
+			f, ok := u.next()
+			if !ok {
+				break
+			}
+			if err := writeTAP(f.vlan, f.frame); err != nil {
+				atomic.AddUint64(&stats.TAPWriteErrors, 1)
+				logSwitch.Error("tap_write_failed", nil, "frame %v: writing to TAP interface: %v", Frame(f.frame), err)
+			}
+		}
+	}
+}
@@ -0,0 +1,53 @@
+/* go-websockproxy - https://github.com/gdm85/go-websockproxy
+Copyright (C) 2016 gdm85
+
+This program is free software; you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation; either version 2 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License along
+with this program; if not, write to the Free Software Foundation, Inc.,
+51 Franklin Street, Fifth Floor, Boston, MA 02110-1301 USA.
+*/
+package main
+
+import (
+	"encoding/binary"
+
+	"github.com/songgao/water/waterutil"
+)
+
+// tag protocol identifier of IEEE 802.1Q frames
+const vlanTPID = 0x8100
+
+// tagFrame returns a copy of the frame with an IEEE 802.1Q tag for the specified VLAN.
+func tagFrame(frame []byte, vlan int) []byte {
+	tagged := make([]byte, len(frame)+4)
+	copy(tagged, frame[:12])
+	binary.BigEndian.PutUint16(tagged[12:14], vlanTPID)
+	binary.BigEndian.PutUint16(tagged[14:16], uint16(vlan&0x0fff))
+	copy(tagged[16:], frame[12:])
+	return tagged
+}
+
+// untagFrame removes in place the IEEE 802.1Q tag of a frame and returns its VLAN with the untagged frame;
+// frames without tag belong to VLAN 0.
+func untagFrame(frame []byte) (int, []byte) {
+	if len(frame) < 18 || waterutil.MACTagging(frame) != waterutil.Tagged {
+		return 0, frame
+	}
+	vlan := int(binary.BigEndian.Uint16(frame[14:16]) & 0x0fff)
+	copy(frame[12:], frame[16:])
+	return vlan, frame[:len(frame)-4]
+}
+
+// isTagged returns true if the frame carries any VLAN tag.
+func isTagged(frame []byte) bool {
+	return len(frame) >= 14 && waterutil.MACTagging(frame) != waterutil.NotTagged
+}
@@ -0,0 +1,210 @@
+/* go-websockproxy - https://github.com/gdm85/go-websockproxy
+Copyright (C) 2016 gdm85
+
+This program is free software; you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation; either version 2 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License along
+with this program; if not, write to the Free Software Foundation, Inc.,
+51 Franklin Street, Fifth Floor, Boston, MA 02110-1301 USA.
+*/
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// max number of decisions kept in the webhook cache
+const maxWebhookCacheEntries = 1024
+
+var (
+	errWebhookDenied      = errors.New("denied by authorization webhook")
+	errWebhookUnavailable = errors.New("authorization webhook unavailable")
+)
+
+// WebhookRequest is the body POSTed to the authorization webhook for each credential to verify.
+type WebhookRequest struct {
+	Credential    string `json:"credential"`
+	RemoteAddress string `json:"remote-address"`
+	// VLAN is the network requested by the client with the 'vlan' URL query parameter
+	VLAN int `json:"vlan"`
+}
+
+// WebhookResponse is the decision of the authorization webhook; the policy fields have the same meaning as in the key file.
+type WebhookResponse struct {
+	Allow  bool   `json:"allow"`
+	Reason string `json:"reason"`
+	KeyEntry
+	// SessionLifetime limits the duration of sessions authorized with this decision (e.g. '8h')
+	SessionLifetime string `json:"session-lifetime"`
+}
+
+// webhookDecision is a cached response of the webhook.
+type webhookDecision struct {
+	response *WebhookResponse
+	expires  time.Time
+}
+
+// webhookCache holds the recent decisions of the webhook, by hash of the request.
+type webhookCache struct {
+	sync.Mutex
+	decisions map[string]webhookDecision
+}
+
+var webhookDecisions = webhookCache{decisions: map[string]webhookDecision{}}
+
+// webhookCacheKey returns the cache key of a webhook request; credentials are not kept in memory in clear.
+func webhookCacheKey(url string, req *WebhookRequest) string {
+	h := sha256.New()
+	fmt.Fprintf(h, "%s\x00%s\x00%s\x00%d", url, req.Credential, addressKey(req.RemoteAddress), req.VLAN)
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// get returns the cached decision for the key, if any.
+func (wc *webhookCache) get(key string, now time.Time) *WebhookResponse {
+	wc.Lock()
+	defer wc.Unlock()
+	d, ok := wc.decisions[key]
+	if !ok {
+		return nil
+	}
+	if !now.Before(d.expires) {
+		delete(wc.decisions, key)
+		return nil
+	}
+	return d.response
+}
+
+// put caches a decision; when the cache is full expired decisions are evicted, and the decision is not cached if
+// there is still no room.
+func (wc *webhookCache) put(key string, response *WebhookResponse, now time.Time) {
+	wc.Lock()
+	defer wc.Unlock()
+	if len(wc.decisions) >= maxWebhookCacheEntries {
+		for k, d := range wc.decisions {
+			if !now.Before(d.expires) {
+				delete(wc.decisions, k)
+			}
+		}
+		if len(wc.decisions) >= maxWebhookCacheEntries {
+			return
+		}
+	}
+	wc.decisions[key] = webhookDecision{response: response, expires: now.Add(authWebhookCacheTTL)}
+}
+
+// requestedVLAN returns the network requested with the 'vlan' URL query parameter, 0 if missing or invalid.
+func requestedVLAN(r *http.Request) int {
+	vlan, err := strconv.Atoi(r.URL.Query().Get("vlan"))
+	if err != nil || vlan < 0 || vlan > 4094 {
+		return 0
+	}
+	return vlan
+}
+
+// callWebhook POSTs the request to the authorization webhook and returns its decision.
+func callWebhook(url string, req *WebhookRequest) (*WebhookResponse, error) {
+	body, err := json.Marshal(req)
+	if err != nil {
+		return nil, err
+	}
+	client := &http.Client{Timeout: authWebhookTimeout}
+	resp, err := client.Post(url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status %s", resp.Status)
+	}
+	var response WebhookResponse
+	if err := json.NewDecoder(resp.Body).Decode(&response); err != nil {
+		return nil, fmt.Errorf("parsing response: %v", err)
+	}
+	if response.Allow && response.Identity == "" {
+		return nil, errors.New("response without identity")
+	}
+	return &response, nil
+}
+
+// webhookPolicy returns the policy decided by the authorization webhook for a credential presented by a client;
+// errWebhookDenied is returned (wrapped) when the credential is denied, errWebhookUnavailable when the webhook cannot
+// decide and failing closed.
+func (cfg *Config) webhookPolicy(credential, remoteAddress string, vlan int) (*Policy, error) {
+	req := &WebhookRequest{Credential: credential, RemoteAddress: remoteAddress, VLAN: vlan}
+	now := time.Now()
+	key := webhookCacheKey(cfg.AuthWebhook, req)
+
+	response := webhookDecisions.get(key, now)
+	if response == nil {
+		var err error
+		response, err = callWebhook(cfg.AuthWebhook, req)
+		if err != nil {
+			if authWebhookFailure == "open" {
+				logAuth.Warning("webhook_failed_open", nil, "authorization webhook: %v; failing open", err)
+				p := cfg.defaultPolicy()
+				p.credential = credentialWebhook
+				p.key = credential
+				return p, nil
+			}
+			logAuth.Warning("webhook_failed", nil, "authorization webhook: %v", err)
+			return nil, errWebhookUnavailable
+		}
+		if authWebhookCacheTTL > 0 {
+			webhookDecisions.put(key, response, now)
+		}
+	}
+
+	if !response.Allow {
+		if response.Reason == "" {
+			return nil, errWebhookDenied
+		}
+		return nil, fmt.Errorf("%w: %s", errWebhookDenied, response.Reason)
+	}
+
+	entry := response.KeyEntry
+	entry.Key = credential
+	p, err := cfg.newPolicy(&entry)
+	if err != nil {
+		logAuth.Warning("webhook_invalid_policy", nil, "authorization webhook: invalid policy: %v", err)
+		return nil, errWebhookUnavailable
+	}
+	p.credential = credentialWebhook
+	if response.SessionLifetime != "" {
+		lifetime, err := time.ParseDuration(response.SessionLifetime)
+		if err != nil {
+			logAuth.Warning("webhook_invalid_policy", nil, "authorization webhook: invalid session lifetime: %v", err)
+			return nil, errWebhookUnavailable
+		}
+		if expires := now.Add(lifetime); p.Expires.IsZero() || expires.Before(p.Expires) {
+			p.Expires = expires
+		}
+	}
+	return p, nil
+}
+
+// authorizeWebhook authorizes the client with the decision of the webhook; it returns true if the client should be put
+// in the idle loop.
+func (c *Client) authorizeWebhook(credential string) (bool, error) {
+	policy, err := c.hub.Config().webhookPolicy(credential, c.remoteAddress, requestedVLAN(c.ws.Request()))
+	if err != nil {
+		return errors.Is(err, errWebhookDenied), err
+	}
+	return c.authorize(policy)
+}
@@ -0,0 +1,198 @@
+/* go-websockproxy - https://github.com/gdm85/go-websockproxy
+Copyright (C) 2016 gdm85
+
+This program is free software; you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation; either version 2 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License along
+with this program; if not, write to the Free Software Foundation, Inc.,
+51 Franklin Street, Fifth Floor, Boston, MA 02110-1301 USA.
+*/
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// newTestWebhook starts an authorization webhook answering with the response returned by decide, and returns the
+// configuration using it together with the number of requests received; the webhook cache starts empty.
+func newTestWebhook(t *testing.T, decide func(req *WebhookRequest) *WebhookResponse) (*Config, *int32) {
+	var calls int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&calls, 1)
+		var req WebhookRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		json.NewEncoder(w).Encode(decide(&req))
+	}))
+	t.Cleanup(srv.Close)
+	setWebhookOptions(t, time.Second, time.Minute, "closed")
+	return &Config{AuthWebhook: srv.URL}, &calls
+}
+
+// setWebhookOptions sets the webhook command-line options for the duration of a test.
+func setWebhookOptions(t *testing.T, timeout, cacheTTL time.Duration, failure string) {
+	oldTimeout, oldCacheTTL, oldFailure := authWebhookTimeout, authWebhookCacheTTL, authWebhookFailure
+	authWebhookTimeout, authWebhookCacheTTL, authWebhookFailure = timeout, cacheTTL, failure
+	webhookDecisions = webhookCache{decisions: map[string]webhookDecision{}}
+	t.Cleanup(func() {
+		authWebhookTimeout, authWebhookCacheTTL, authWebhookFailure = oldTimeout, oldCacheTTL, oldFailure
+	})
+}
+
+func TestWebhookAllow(t *testing.T) {
+	cfg, _ := newTestWebhook(t, func(req *WebhookRequest) *WebhookResponse {
+		if req.Credential != "secret" || req.RemoteAddress != "192.0.2.1:1234" || req.VLAN != 7 {
+			return &WebhookResponse{Reason: "unexpected request"}
+		}
+		return &WebhookResponse{
+			Allow: true,
+			KeyEntry: KeyEntry{
+				Identity:           "alice",
+				VLAN:               7,
+				MaxSessions:        2,
+				MaxUploadBandwidth: "1mbit",
+			},
+			SessionLifetime: "1h",
+		}
+	})
+
+	before := time.Now()
+	p, err := cfg.webhookPolicy("secret", "192.0.2.1:1234", 7)
+	if err != nil {
+		t.Fatalf("credential not accepted: %v", err)
+	}
+	if p.Identity != "alice" || p.VLAN != 7 || p.MaxSessions != 2 {
+		t.Errorf("unexpected policy %+v", p)
+	}
+	if p.uploadBandwidth != (Bandwidth{rate: 125000}) {
+		t.Errorf("upload bandwidth is %v", p.uploadBandwidth)
+	}
+	if p.credential != credentialWebhook || p.key != "secret" {
+		t.Errorf("policy not bound to the webhook credential")
+	}
+	if p.Expires.Before(before.Add(time.Hour)) || p.Expires.After(time.Now().Add(time.Hour)) {
+		t.Errorf("session lifetime not applied, expires %v", p.Expires)
+	}
+}
+
+func TestWebhookDeny(t *testing.T) {
+	cfg, _ := newTestWebhook(t, func(req *WebhookRequest) *WebhookResponse {
+		return &WebhookResponse{Reason: "account suspended"}
+	})
+
+	_, err := cfg.webhookPolicy("secret", "192.0.2.1:1234", 0)
+	if !errors.Is(err, errWebhookDenied) {
+		t.Fatalf("expected denial, got %v", err)
+	}
+	if err.Error() != errWebhookDenied.Error()+": account suspended" {
+		t.Errorf("denial reason not reported: %v", err)
+	}
+}
+
+func TestWebhookCache(t *testing.T) {
+	cfg, calls := newTestWebhook(t, func(req *WebhookRequest) *WebhookResponse {
+		return &WebhookResponse{Allow: true, KeyEntry: KeyEntry{Identity: "alice"}}
+	})
+
+	for i := 0; i < 3; i++ {
+		if _, err := cfg.webhookPolicy("secret", "192.0.2.1:1234", 0); err != nil {
+			t.Fatalf("credential not accepted: %v", err)
+		}
+	}
+	if n := atomic.LoadInt32(calls); n != 1 {
+		t.Errorf("webhook called %d times for the same request, want 1", n)
+	}
+
+	// a different credential is a different request
+	if _, err := cfg.webhookPolicy("other", "192.0.2.1:1234", 0); err != nil {
+		t.Fatalf("credential not accepted: %v", err)
+	}
+	if n := atomic.LoadInt32(calls); n != 2 {
+		t.Errorf("webhook called %d times, want 2", n)
+	}
+}
+
+func TestWebhookCacheDisabled(t *testing.T) {
+	cfg, calls := newTestWebhook(t, func(req *WebhookRequest) *WebhookResponse {
+		return &WebhookResponse{Allow: true, KeyEntry: KeyEntry{Identity: "alice"}}
+	})
+	authWebhookCacheTTL = 0
+
+	for i := 0; i < 2; i++ {
+		if _, err := cfg.webhookPolicy("secret", "192.0.2.1:1234", 0); err != nil {
+			t.Fatalf("credential not accepted: %v", err)
+		}
+	}
+	if n := atomic.LoadInt32(calls); n != 2 {
+		t.Errorf("webhook called %d times with caching disabled, want 2", n)
+	}
+}
+
+// newHangingWebhook starts an authorization webhook which never answers within the test timeout.
+func newHangingWebhook(t *testing.T, failure string) *Config {
+	release := make(chan struct{})
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+	}))
+	t.Cleanup(srv.Close)
+	t.Cleanup(func() { close(release) })
+	setWebhookOptions(t, 50*time.Millisecond, time.Minute, failure)
+	return &Config{AuthWebhook: srv.URL, AuthKey: "shared"}
+}
+
+func TestWebhookTimeoutFailClosed(t *testing.T) {
+	cfg := newHangingWebhook(t, "closed")
+
+	start := time.Now()
+	_, err := cfg.webhookPolicy("secret", "192.0.2.1:1234", 0)
+	if err != errWebhookUnavailable {
+		t.Fatalf("expected webhook unavailable, got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("timeout not applied, waited %v", elapsed)
+	}
+}
+
+func TestWebhookTimeoutFailOpen(t *testing.T) {
+	cfg := newHangingWebhook(t, "open")
+
+	p, err := cfg.webhookPolicy("secret", "192.0.2.1:1234", 0)
+	if err != nil {
+		t.Fatalf("expected to fail open, got %v", err)
+	}
+	if p.Identity != "" || p.credential != credentialWebhook || p.key != "secret" {
+		t.Errorf("expected the default policy, got %+v", p)
+	}
+}
+
+func TestWebhookFailureNotCached(t *testing.T) {
+	cfg, calls := newTestWebhook(t, func(req *WebhookRequest) *WebhookResponse {
+		// allowed without identity: an invalid response
+		return &WebhookResponse{Allow: true}
+	})
+
+	for i := 0; i < 2; i++ {
+		if _, err := cfg.webhookPolicy("secret", "192.0.2.1:1234", 0); err != errWebhookUnavailable {
+			t.Fatalf("expected webhook unavailable, got %v", err)
+		}
+	}
+	if n := atomic.LoadInt32(calls); n != 2 {
+		t.Errorf("failed webhook calls cached: %d calls, want 2", n)
+	}
+}
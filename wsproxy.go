@@ -23,6 +23,10 @@ import (
 	"net/http"
 	"os"
 	"os/exec"
+	"os/signal"
+	"sync/atomic"
+	"syscall"
+	"time"
 
 	flag "github.com/ogier/pflag"
 	"github.com/songgao/water"
@@ -42,10 +46,88 @@ func (f Frame) String() string {
 	return fmt.Sprintf("{%d bytes [%s] -> [%s]}", len(f), waterutil.MACSource(f), waterutil.MACDestination(f))
 }
 
+// refuseSession closes the connection of a client whose credential was accepted but which cannot have a session now,
+// so that it knows why it was not authorized; it returns true if the connection was closed.
+func refuseSession(client *Client, err error) bool {
+	var code int
+	switch err {
+	case errTooManySessions:
+		code = closeTryAgainLater
+	case errQuotaExceeded:
+		code = closePolicyViolation
+	default:
+		return false
+	}
+	client.Close(code, err.Error())
+	hub.Remove(client)
+	return true
+}
+
 // websocketHandler is the main websocekt connections handling entrypoint.
 func websocketHandler(ws *websocket.Conn) {
 	var flaggedAsBad bool
-	client := hub.Add(ws)
+	client, err := hub.Add(ws)
+	if err != nil {
+		logConn.Info("connection_refused", nil, "refusing websocket connection from %s: %v", ws.Request().RemoteAddr, err)
+		code := closeTryAgainLater
+		if err == errShuttingDown {
+			atomic.AddUint64(&stats.HandshakesUnavailable, 1)
+			code = closeGoingAway
+		} else {
+			atomic.AddUint64(&stats.HandshakesLimited, 1)
+		}
+		closeWebsocket(ws, code, err.Error())
+		return
+	}
+	atomic.AddUint64(&stats.HandshakesAccepted, 1)
+	if policy := requestPolicy(ws.Request()); policy != nil {
+		// authenticated during the handshake
+		if _, err := client.authorize(policy); err != nil {
+			logAuth.Info("handshake_authorization_failed", client, "%v", err)
+			if !refuseSession(client, err) {
+				client.Close(closePolicyViolation, err.Error())
+				hub.Remove(client)
+			}
+			return
+		}
+	} else if cert := requestCertificate(ws.Request()); cert != nil && !client.isAuthorized() {
+		policy := hub.Config().certificatePolicy(cert)
+		if policy == nil {
+			logAuth.Warning("certificate_without_identity", client, "client certificate without identity")
+		} else if _, err := client.authorize(policy); err != nil {
+			logAuth.Warning("certificate_not_accepted", client, "client certificate not accepted: %v", err)
+			if refuseSession(client, err) {
+				return
+			}
+		}
+	} else if token := ws.Request().URL.Query().Get("token"); token != "" && !client.isAuthorized() {
+		flaggedAsBad, err = client.authorizeToken(token)
+		if err != nil {
+			logAuth.Warning("token_not_accepted", client, "access token in URL not accepted: %v", err)
+			if refuseSession(client, err) {
+				return
+			}
+		}
+		if flaggedAsBad && banIfRepeated(client, "failed authorization") {
+			return
+		}
+	}
+	if !client.isAuthorized() {
+		if err := client.sendChallenge(); err != nil {
+			logAuth.Error("challenge_failed", client, "sending authorization challenge: %v", err)
+		}
+		if authTimeout > 0 {
+			deadline := time.AfterFunc(authTimeout, func() {
+				if !client.isAuthorized() {
+					logAuth.Info("auth_timeout", client, "not authorized within %v", authTimeout)
+					atomic.AddUint64(&stats.AuthTimeouts, 1)
+					client.Close(closePolicyViolation, "authorization timeout")
+				}
+			})
+			defer deadline.Stop()
+		}
+	}
+	var unauthorizedFrames, unauthorizedBytes int64
 	for {
 		var frame []byte
 		err := websocket.Message.Receive(ws, &frame)
@@ -55,14 +137,32 @@ func websocketHandler(ws *websocket.Conn) {
 				hub.Remove(client)
 				return
 			}
-			WarningPrintf("client %v: dropping after read error: %v", client, err)
+			if client.isTerminated() {
+				// connection was closed on purpose by the hub
+				hub.Remove(client)
+				return
+			}
+			logConn.Warning("read_failed", client, "dropping after read error: %v", err)
 			hub.Remove(client)
 			return
 		}
 
+		if !client.isAuthorized() {
+			unauthorizedFrames++
+			unauthorizedBytes += int64(len(frame))
+			if (maxUnauthorizedFrames > 0 && unauthorizedFrames > maxUnauthorizedFrames) || (maxUnauthorizedBytes > 0 && unauthorizedBytes > maxUnauthorizedBytes) {
+				logAuth.Info("unauthorized_limit_exceeded", client, "too much traffic before authorization (%d frames, %d bytes)", unauthorizedFrames, unauthorizedBytes)
+				atomic.AddUint64(&stats.UnauthorizedLimitCloses, 1)
+				client.Close(closePolicyViolation, "too much traffic before authorization")
+				hub.Remove(client)
+				return
+			}
+		}
+
 		if flaggedAsBad {
 			// discard all frames of this connection, but keep it open to mitigate many reconnections
-			DebugPrintf("frame %v sent to /dev/null", frame)
+			logAuth.Debug("flagged_drop", client, "frame %v sent to /dev/null", Frame(frame))
+			atomic.AddUint64(&stats.FlaggedDrops, 1)
 			continue
 		}
 
@@ -72,18 +172,25 @@ func websocketHandler(ws *websocket.Conn) {
 
 		if len(frame) < 12 {
 			// this frame can't possibly be good
-			WarningPrintf("client %v: skipping too short frame (%d bytes)", client, len(frame))
+			logSwitch.Warning("too_short_drop", client, "skipping too short frame (%d bytes)", len(frame))
+			atomic.AddUint64(&stats.TooShortDrops, 1)
 			continue
 		}
 
 		// special frames have an invalid source MAC made of 0s
-		if string(frame[:6]) == "\x00\x00\x00\x00\x00\x00" {
+		if isSpecialFrame(frame) {
 			skipFrame, flagAsBad, err := client.HandleSpecialFrame(frame[6:])
 			if err != nil {
-				WarningPrintf("client %v, frame %v: %v", client, Frame(frame), err)
+				logAuth.Warning("special_frame_rejected", client, "frame %v: %v", Frame(frame), err)
+				if refuseSession(client, err) {
+					return
+				}
 			}
 			if flagAsBad {
 				flaggedAsBad = true
+				if banIfRepeated(client, "failed authorization") {
+					return
+				}
 				continue
 			}
 			if skipFrame {
@@ -92,10 +199,11 @@ func websocketHandler(ws *websocket.Conn) {
 		}
 
 		// discard frames of clients that are not authorized
-		if !client.authorized {
-			WarningPrintf("client %v, frame %v: discarding unauthorized", client, Frame(frame))
+		if !client.isAuthorized() {
+			logAuth.Warning("unauthorized_drop", client, "frame %v: discarding unauthorized", Frame(frame))
+			atomic.AddUint64(&stats.UnauthorizedDrops, 1)
 			if len(frame) < 60 {
-				WarningPrintf("discarded: %s", string(frame))
+				logAuth.Debug("unauthorized_frame_dump", client, "discarded: %q", frame)
 			}
 			continue
 		}
@@ -107,185 +215,480 @@ func websocketHandler(ws *websocket.Conn) {
 		// check if client can send this frame with its source MAC
 		flagAsBad, err := hub.CanSourceMAC(client, waterutil.MACSource(frame))
 		if err != nil {
-			WarningPrintf("client %v, frame %v: %v", client, Frame(frame), err)
+			logSwitch.Warning("spoofed_mac_drop", client, "frame %v: %v", Frame(frame), err)
+			atomic.AddUint64(&stats.SpoofedMACDrops, 1)
 			if flagAsBad {
 				flaggedAsBad = true
+				if banIfRepeated(client, "spoofing") {
+					return
+				}
 			}
 			continue
 		}
 
-		switched, err := hub.SwitchFrame(client, frame)
-		if err != nil {
-			ErrorPrintf("client %v, frame %v: dropping client because of TAP switch error: %v", client, Frame(frame), err)
-			hub.Remove(client)
-			return
+		// VLANs are assigned by the server
+		if isTagged(frame) {
+			logSwitch.Warning("tagged_drop", client, "frame %v: discarding VLAN tagged frame", Frame(frame))
+			atomic.AddUint64(&stats.TaggedDrops, 1)
+			continue
 		}
 
-		if !switched {
-			DebugPrintf("client %v, frame %v: frame could not be switched")
+		if !client.AdmitUpload(frame) {
+			logLimit.Debug("packet_rate_limit_drop", client, "frame %v: discarding because of packet rate limiting", Frame(frame))
+			continue
+		}
+
+		if !client.LimitUpload(len(frame), classifyFrame(frame)) {
+			atomic.AddUint64(&stats.UploadRateLimitDrops, 1)
+			logLimit.Warning("upload_rate_limit_drop", client, "frame %v: discarding because of upload rate limiting", Frame(frame))
+			continue
+		}
+
+		client.accountTraffic(len(frame))
+		metrics.CountTraffic(client, directionUpload, len(frame))
+		copies, delay := impairments.Impair(client, impairUpload, frame)
+		for i := 0; i < copies; i++ {
+			if delay != 0 {
+				time.AfterFunc(delay, func() {
+					if !client.isTerminated() {
+						switchFrame(client, frame)
+					}
+				})
+				continue
+			}
+			switchFrame(client, frame)
 		}
 	}
 }
 
+// switchFrame switches a frame uploaded by the client.
+func switchFrame(client *Client, frame []byte) {
+	if !hub.SwitchFrame(client, client.Policy().VLAN, frame) {
+		logSwitch.Debug("frame_not_switched", client, "frame %v: frame could not be switched", Frame(frame))
+	}
+}
+
+// flagSet returns true if the command-line option was specified.
+func flagSet(name string) bool {
+	var set bool
+	flag.Visit(func(f *flag.Flag) {
+		if f.Name == name {
+			set = true
+		}
+	})
+	return set
+}
+
+// banIfRepeated records an incident caused by the client; if its remote address is banned as result, the client is
+// disconnected and true is returned.
+func banIfRepeated(client *Client, reason string) bool {
+	if !bans.RecordIncident(client.remoteAddress, reason) {
+		return false
+	}
+	client.Close(closePolicyViolation, "banned")
+	hub.Remove(client)
+	return true
+}
+
 func readTAPTraffic() error {
 	frame := make([]byte, 1500+18)
 	for {
 		n, err := tap.Read(frame)
 		if err != nil {
+			atomic.AddUint64(&stats.TAPReadErrors, 1)
 			return err
 		}
 		if n < 12 {
-			WarningPrintf("discarding invalid frame with size of %d bytes read from TAP interface", n)
+			logSwitch.Warning("too_short_drop", nil, "discarding invalid frame with size of %d bytes read from TAP interface", n)
+			atomic.AddUint64(&stats.TooShortDrops, 1)
 			continue
 		}
 
-		switched, err := hub.SwitchFrame(nil, frame)
-		if err != nil {
-			return err
-		}
+		// frame is queued for delivery, thus it cannot share the read buffer
+		f := make([]byte, n)
+		copy(f, frame[:n])
+		vlan, f := untagFrame(f)
 
-		if !switched {
-			DebugPrintf("frame %v: could not switch from TAP interface", Frame(frame))
+		if !hub.SwitchFrame(nil, vlan, f) {
+			logSwitch.Debug("frame_not_switched", nil, "frame %v: could not switch from TAP interface", Frame(f))
 		}
 	}
 }
 
-type PrintFunc func(string, ...interface{})
-
-// ErrorPrintf prints a (formatted) error to standard error.
-func ErrorPrintf(format string, a ...interface{}) {
-	fmt.Fprintf(os.Stderr, "ERROR: "+format+"\n", a...)
-}
-func warningPrintf(format string, a ...interface{}) {
-	fmt.Fprintf(os.Stderr, "WARNING: "+format+"\n", a...)
-}
-func debugPrintf(format string, a ...interface{}) {
-	fmt.Printf("DEBUG: "+format+"\n", a...)
-}
-func infoPrintf(format string, a ...interface{}) {
-	fmt.Printf(format+"\n", a...)
-}
-func dummyPrintf(format string, a ...interface{}) {
-	// do nothing
-}
-
 var (
-	hub = NewHub()       // clients management hub
-	tap *water.Interface // TAP interface
-	// set of functions to provide CLI logging output
-	DebugPrintf, InfoPrintf, WarningPrintf PrintFunc
+	hub             = NewHub()       // clients management hub
+	bans            = NewBanList()   // remote addresses banned after repeated incidents
+	allowedOrigins  []originPattern  // Origin allowlist of websocket handshakes
+	tap             *water.Interface // TAP interface
+	priorityWeights []int            // weights of priority classes for delivery to clients; nil for strict priority
 
-	uploadBandwidth, downloadBandwidth int64
 	// CLI options follow:
-	logLevel             string
-	listenAddress        string
-	staticDirectory      string
-	maxUploadBandwidth   string
-	maxDownloadBandwidth string
-	tapName              string // re-using an existing TAP is not yet supported
-	tapIPv4              string
-	authKey              string
-	macPrefix            string
-	certFile             string
-	keyFile              string
+	logLevel                     string
+	logLevels                    string
+	logFormat                    string
+	logSampling                  int
+	listenAddress                string
+	staticDirectory              string
+	maxUploadBandwidth           string
+	maxDownloadBandwidth         string
+	maxControlBandwidth          string
+	maxIdentityUploadBandwidth   string
+	maxIdentityDownloadBandwidth string
+	maxNetworkUploadBandwidth    string
+	maxNetworkDownloadBandwidth  string
+	maxTotalUploadBandwidth      string
+	maxTotalDownloadBandwidth    string
+	maxQueuedBytes               int64
+	priorityScheduling           string
+	tapName                      string // re-using an existing TAP is not yet supported
+	tapIPv4                      string
+	authKey                      string
+	authKeyFile                  string
+	allowPlainAuth               bool
+	tokenSecret                  string
+	authWebhook                  string
+	authWebhookTimeout           time.Duration
+	authWebhookCacheTTL          time.Duration
+	authWebhookFailure           string
+	handshakeAuth                bool
+	macPrefix                    string
+	certFile                     string
+	keyFile                      string
+	clientCAFile                 string
+	clientCRLFile                string
+	shutdownTimeout              time.Duration
+	authTimeout                  time.Duration
+	maxUnauthorizedFrames        int64
+	maxUnauthorizedBytes         int64
+	banListFile                  string
+	originAllowlist              string
+	originCheck                  string
+	banThreshold                 int
+	maxClients                   int
+	maxClientsPerAddress         int
+	maxSessionsPerIdentity       int
+	evictOldestSession           bool
+	ipv4PrefixLength             int
+	ipv6PrefixLength             int
+	banDuration                  time.Duration
+	maxBanDuration               time.Duration
+	writeTimeout                 time.Duration
+	slowConsumerTimeout          time.Duration
+	slowConsumerAction           string
+	rateLimitMode                string
+	maxShapingDelay              time.Duration
+	maxPacketsPerSecond          int64
+	maxBroadcastsPerSecond       int64
+	stormThreshold               int
+	stormQuarantine              time.Duration
+	quota                        string
+	quotaPeriodLength            string
+	quotaAction                  string
+	quotaFallback                string
+	quotaFallbackBandwidth       Bandwidth
+	quotaWarning                 int
+	quotaStateFile               string
+	uplinkQueueLength            int
+	backpressure                 bool
+	maxClientPause               time.Duration
+	impairmentSeed               int64
+	configFile                   string
+	adminAddress                 string
+	metricsAddress               string
+	metricsIdentityLabels        bool
 )
 
 func init() {
 	flag.StringVar(&tapIPv4, "tap-ipv4", "10.3.0.1/16", "IPv4 address for the TAP interface; used only when interface is created")
-	flag.StringVar(&maxUploadBandwidth, "max-upload-bandwidth", "", "max upload bandwidth per client; leave empty for unlimited")
-	flag.StringVar(&maxDownloadBandwidth, "max-download-bandwidth", "", "max upload bandwidth per client; leave empty for unlimited")
+	flag.StringVar(&maxUploadBandwidth, "max-upload-bandwidth", "", "max upload bandwidth per client, applied to all the frames it sends whether they are written to the TAP interface or delivered to other clients; leave empty for unlimited")
+	flag.StringVar(&maxDownloadBandwidth, "max-download-bandwidth", "", "max download bandwidth per client, applied to all the frames delivered to it; leave empty for unlimited")
+	flag.StringVar(&maxControlBandwidth, "max-control-bandwidth", "", "max bandwidth per client and direction for control traffic (ARP, DHCP, ICMP), which is otherwise not rate limited")
+	flag.StringVar(&maxIdentityUploadBandwidth, "max-identity-upload-bandwidth", "", "max upload bandwidth shared by the clients of each identity; leave empty for unlimited")
+	flag.StringVar(&maxIdentityDownloadBandwidth, "max-identity-download-bandwidth", "", "max download bandwidth shared by the clients of each identity; leave empty for unlimited")
+	flag.StringVar(&maxNetworkUploadBandwidth, "max-network-upload-bandwidth", "", "max upload bandwidth shared by the clients of each virtual network; leave empty for unlimited")
+	flag.StringVar(&maxNetworkDownloadBandwidth, "max-network-download-bandwidth", "", "max download bandwidth shared by the clients of each virtual network; leave empty for unlimited")
+	flag.StringVar(&maxTotalUploadBandwidth, "max-total-upload-bandwidth", "", "max upload bandwidth shared by all clients; leave empty for unlimited")
+	flag.StringVar(&maxTotalDownloadBandwidth, "max-total-download-bandwidth", "", "max download bandwidth shared by all clients; leave empty for unlimited")
+	flag.Int64Var(&maxQueuedBytes, "max-queued-bytes", 64<<20, "max total size of the frames queued for delivery to all clients; 0 for unlimited")
+	flag.StringVar(&priorityScheduling, "priority-scheduling", "strict", "delivery scheduling of control, interactive and bulk traffic: 'strict' priority or comma-separated weights (e.g. '8,4,1')")
 	flag.StringVar(&listenAddress, "listen-address", ":8000", "address to listen on for incoming websocket connections; URI is '/wstap'")
 	flag.StringVar(&staticDirectory, "static-directory", "", "static files directory to serve at '/'; disabled by default")
 	flag.StringVar(&logLevel, "log-level", "warning", "one of 'debug', 'info', 'warning', 'error'")
+	flag.StringVar(&logLevels, "log-levels", "", "comma-separated log levels of single subsystems overriding 'log-level', e.g. 'switch=debug,auth=info'; subsystems are main, conn, auth, switch, limit and admin")
+	flag.StringVar(&logFormat, "log-format", "text", "format of log events: 'text' or 'json'")
+	flag.IntVar(&logSampling, "log-sampling", 10, "max number of warnings of the same event logged per second, further ones are counted in the next logged one; 0 to log all warnings")
 	flag.StringVar(&authKey, "auth-key", "", "accept TAP traffic via websockets only if authorized with this key; by default is disabled (accepts any traffic)")
+	flag.StringVar(&authKeyFile, "auth-key-file", "", "JSON file with the keys accepted for authorization and their policies; can be used together with 'auth-key'")
+	flag.BoolVar(&allowPlainAuth, "allow-plain-auth", true, "accept keys sent in clear with the AUTH special frame, for clients not supporting challenge-response; enabled by default for compatibility, it will be disabled by default in a future release")
+	flag.StringVar(&tokenSecret, "token-secret", "", "secret for verifying signed access tokens, accepted with AUTH special frames or in the 'token' URL query parameter")
+	flag.BoolVar(&handshakeAuth, "handshake-auth", false, "authenticate websocket connections before the upgrade with the Authorization bearer, the 'wstap_auth' cookie or the 'token' URL query parameter")
 	flag.StringVar(&macPrefix, "mac-prefix", "", "accept websockets traffic only with MACs starting with the specified prefix (default is disabled)")
 	flag.StringVar(&certFile, "cert-file", "", "certificate for listening on TLS connections; by default TLS is disabled")
 	flag.StringVar(&keyFile, "key-file", "", "key file for listening on TLS connections; by default TLS is disabled")
+	flag.StringVar(&clientCAFile, "client-ca-file", "", "PEM bundle of certificate authorities; clients presenting a valid certificate are authorized with its subject as identity")
+	flag.StringVar(&clientCRLFile, "client-crl-file", "", "CRL of the revoked client certificates; reloaded on SIGHUP")
+	flag.StringVar(&configFile, "config-file", "", "JSON file overriding the reloadable options (authorization, MAC prefix, bandwidth and memory limits); reloaded on SIGHUP")
+	flag.StringVar(&metricsAddress, "metrics-address", "", "address to listen on for the Prometheus metrics endpoint at '/metrics' (e.g. '127.0.0.1:9100'); disabled by default, metrics are also served by the administrative interface")
+	flag.BoolVar(&metricsIdentityLabels, "metrics-identity-labels", false, "label client metrics with the identity of the clients, for deployments with a limited number of identities")
+	flag.StringVar(&adminAddress, "admin-address", "", "address to listen on for the administrative interface (e.g. '127.0.0.1:8001'); disabled by default")
+	flag.DurationVar(&writeTimeout, "write-timeout", 10*time.Second, "disconnect clients which do not accept a frame within this time; 0 to disable")
+	flag.DurationVar(&slowConsumerTimeout, "slow-consumer-timeout", 30*time.Second, "apply the slow consumer action to clients whose queue drops frames for longer than this time; 0 to disable")
+	flag.StringVar(&slowConsumerAction, "slow-consumer-action", "evict", "action on slow consumers: 'evict' to disconnect them or 'degrade' to deliver only control traffic until they catch up")
+	flag.StringVar(&originAllowlist, "allowed-origins", "", "comma-separated list of origins allowed to open websockets, exact (e.g. 'https://example.com') or with wildcards (e.g. '*.example.com'); by default any origin is allowed")
+	flag.StringVar(&originCheck, "origin-check", "always", "when to enforce the allowed origins: 'always' or only for 'unauthenticated' networks, i.e. when authorization is disabled")
+	flag.IntVar(&maxClients, "max-clients", 0, "max number of connected clients; 0 for unlimited")
+	flag.IntVar(&maxClientsPerAddress, "max-clients-per-address", 0, "max number of clients connected from the same remote address or subnet; 0 for unlimited")
+	flag.IntVar(&maxSessionsPerIdentity, "max-sessions-per-identity", 0, "max number of sessions of an identity, unless specified by its policy; 0 for unlimited")
+	flag.BoolVar(&evictOldestSession, "evict-oldest-session", false, "when an identity reaches its max sessions, disconnect its oldest session instead of refusing the new one")
+	flag.IntVar(&ipv4PrefixLength, "ipv4-prefix-length", 32, "prefix length of the subnets in which IPv4 remote addresses are grouped for bans and connection limits")
+	flag.IntVar(&ipv6PrefixLength, "ipv6-prefix-length", 64, "prefix length of the subnets in which IPv6 remote addresses are grouped for bans and connection limits")
+	flag.StringVar(&banListFile, "ban-list-file", "", "JSON file where bans are persisted across restarts; by default bans are kept only in memory")
+	flag.IntVar(&banThreshold, "ban-threshold", 5, "ban remote addresses (grouped in subnets, see 'ipv4-prefix-length' and 'ipv6-prefix-length') after this number of failed authorizations or spoofing attempts; 0 to disable")
+	flag.DurationVar(&banDuration, "ban-duration", time.Minute, "duration of the first ban of an address, doubled with each further ban")
+	flag.DurationVar(&maxBanDuration, "max-ban-duration", 24*time.Hour, "max duration of a ban; offenders are forgotten after this time without incidents")
+	flag.StringVar(&authWebhook, "auth-webhook", "", "URL of an HTTP endpoint deciding the authorization and policy of the credentials presented by clients; disabled by default")
+	flag.DurationVar(&authWebhookTimeout, "auth-webhook-timeout", 2*time.Second, "timeout of the authorization webhook requests")
+	flag.DurationVar(&authWebhookCacheTTL, "auth-webhook-cache-ttl", time.Minute, "time for which decisions of the authorization webhook are cached; 0 to disable caching")
+	flag.StringVar(&authWebhookFailure, "auth-webhook-failure", "closed", "behaviour when the authorization webhook fails: 'closed' to refuse clients or 'open' to authorize them with the default policy")
+	flag.StringVar(&rateLimitMode, "rate-limit-mode", "drop", "what to do with frames exceeding the bandwidth limits: 'drop' them or 'shape' traffic by delaying them")
+	flag.DurationVar(&maxShapingDelay, "max-shaping-delay", 500*time.Millisecond, "in shaping mode, frames which would be delayed longer than this time are dropped")
+	flag.Int64Var(&maxPacketsPerSecond, "max-packets-per-second", 0, "max number of frames per second uploaded by each client; 0 for unlimited")
+	flag.Int64Var(&maxBroadcastsPerSecond, "max-broadcasts-per-second", 0, "max number of broadcast and multicast frames per second uploaded by each client; 0 for unlimited")
+	flag.IntVar(&stormThreshold, "storm-threshold", 0, "quarantine clients whose frames are dropped by the packet rate limits more than this number of times in a second; 0 to disable")
+	flag.DurationVar(&stormQuarantine, "storm-quarantine", 30*time.Second, "duration of the quarantine of clients exceeding the storm threshold, during which all their frames are dropped")
+	flag.StringVar(&quota, "quota", "", "traffic quota per identity and period, uploads and downloads together (e.g. '10GiB'); leave empty for unlimited")
+	flag.StringVar(&quotaPeriodLength, "quota-period", "month", "period after which traffic quotas are renewed: 'day' or 'month' (UTC)")
+	flag.StringVar(&quotaAction, "quota-action", "throttle", "action on clients whose identity exhausted its quota: 'throttle' them to the fallback bandwidth or 'disconnect' them")
+	flag.StringVar(&quotaFallback, "quota-fallback-bandwidth", "64kbit", "bandwidth of clients throttled because their quota is exhausted")
+	flag.IntVar(&quotaWarning, "quota-warning", 90, "percentage of the quota after which clients are notified that it is nearly used")
+	flag.StringVar(&quotaStateFile, "quota-state-file", "", "JSON file where the traffic of each identity is persisted across restarts")
+	flag.Int64Var(&impairmentSeed, "impairment-seed", 1, "default seed of the random source of link impairments, used when none is specified via the admin interface")
+	flag.BoolVar(&backpressure, "backpressure", false, "ask clients exceeding their upload limits to pause with XOFF/XON special frames, and let clients pause the delivery of frames to them")
+	flag.DurationVar(&maxClientPause, "max-client-pause", 5*time.Second, "longest pause of the delivery of frames that a client can request with a XOFF special frame")
+	flag.IntVar(&uplinkQueueLength, "uplink-queue-length", 64, "max number of frames of each client waiting to be written to the TAP interface")
+	flag.DurationVar(&authTimeout, "auth-timeout", 30*time.Second, "disconnect clients which do not authorize within this time; 0 to disable")
+	flag.Int64Var(&maxUnauthorizedFrames, "max-unauthorized-frames", 16, "disconnect clients sending more than this number of frames before authorizing; 0 for unlimited")
+	flag.Int64Var(&maxUnauthorizedBytes, "max-unauthorized-bytes", 64<<10, "disconnect clients sending more than this number of bytes before authorizing; 0 for unlimited")
+	flag.DurationVar(&shutdownTimeout, "shutdown-timeout", 5*time.Second, "time allowed on SIGINT/SIGTERM for delivering pending frames to clients before closing their connections")
 }
 
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "mint-token" {
+		mintTokenCommand(os.Args[2:])
+		return
+	}
 	flag.Parse()
 
-	switch logLevel {
-	case "debug":
-		DebugPrintf = debugPrintf
-		InfoPrintf = infoPrintf
-		WarningPrintf = warningPrintf
-	case "info":
-		DebugPrintf = dummyPrintf
-		InfoPrintf = infoPrintf
-		WarningPrintf = warningPrintf
-	case "warning":
-		DebugPrintf = dummyPrintf
-		InfoPrintf = dummyPrintf
-		WarningPrintf = warningPrintf
-	case "error":
-		DebugPrintf = dummyPrintf
-		InfoPrintf = dummyPrintf
-		WarningPrintf = dummyPrintf
-	default:
-		ErrorPrintf("invalid log level specified")
+	if err := configureLogging(logLevel, logLevels, logFormat, logSampling); err != nil {
+		logMain.Error("invalid_option", nil, "%v", err)
 		os.Exit(1)
 	}
 
 	if (certFile != "" && keyFile == "") || (keyFile != "" && certFile == "") {
-		ErrorPrintf("both certificate and key file should be specified in order to enable TLS connections")
+		logMain.Error("invalid_option", nil, "both certificate and key file should be specified in order to enable TLS connections")
 		os.Exit(2)
 	}
+	if clientCAFile != "" {
+		if certFile == "" {
+			logMain.Error("invalid_option", nil, "TLS must be enabled in order to verify client certificates")
+			os.Exit(2)
+		}
+		if err := loadClientCAs(clientCAFile); err != nil {
+			logMain.Error("startup_failed", nil, "loading client certificate authorities: %v", err)
+			os.Exit(2)
+		}
+	}
 
-	var err error
-	uploadBandwidth, err = parseBandwidth(maxUploadBandwidth)
+	cfg, err := loadConfig()
 	if err != nil {
-		ErrorPrintf("invalid upload bandwidth specified: %v", err)
+		logMain.Error("startup_failed", nil, "loading configuration: %v", err)
 		os.Exit(3)
 	}
-	downloadBandwidth, err = parseBandwidth(maxDownloadBandwidth)
+	hub.SetConfig(cfg)
+
+	if allowPlainAuth && (cfg.AuthKey != "" || cfg.KeyFile != "") && !flagSet("allow-plain-auth") {
+		logMain.Warning("plain_auth_deprecated", nil, "keys sent in clear with AUTH frames are accepted; this will change in a future release, specify --allow-plain-auth explicitly to keep accepting them or --allow-plain-auth=false to require challenge-response")
+	}
+	if !allowPlainAuth && cfg.AuthWebhook != "" {
+		logMain.Warning("webhook_unused", nil, "the authorization webhook is not consulted since credentials sent in clear are not accepted")
+	}
+
+	priorityWeights, err = parsePriorityScheduling(priorityScheduling)
 	if err != nil {
-		ErrorPrintf("invalid download bandwidth specified: %v", err)
+		logMain.Error("invalid_option", nil, "invalid priority scheduling specified: %v", err)
 		os.Exit(4)
 	}
 
+	if slowConsumerAction != "evict" && slowConsumerAction != "degrade" {
+		logMain.Error("invalid_option", nil, "invalid slow consumer action specified")
+		os.Exit(6)
+	}
+
+	if rateLimitMode != "drop" && rateLimitMode != "shape" {
+		logMain.Error("invalid_option", nil, "invalid rate limit mode specified")
+		os.Exit(6)
+	}
+	if maxPacketsPerSecond < 0 || maxBroadcastsPerSecond < 0 || stormThreshold < 0 {
+		logMain.Error("invalid_option", nil, "invalid packet rate limits specified")
+		os.Exit(6)
+	}
+	if maxClientPause < 0 {
+		logMain.Error("invalid_option", nil, "invalid max client pause specified")
+		os.Exit(6)
+	}
+	if uplinkQueueLength < 1 {
+		logMain.Error("invalid_option", nil, "invalid uplink queue length specified")
+		os.Exit(6)
+	}
+	if maxClients < 0 || maxClientsPerAddress < 0 || maxSessionsPerIdentity < 0 {
+		logMain.Error("invalid_option", nil, "invalid connection limits specified")
+		os.Exit(6)
+	}
+	if ipv4PrefixLength < 0 || ipv4PrefixLength > 32 || ipv6PrefixLength < 0 || ipv6PrefixLength > 128 {
+		logMain.Error("invalid_option", nil, "invalid prefix length specified")
+		os.Exit(6)
+	}
+	if authWebhookFailure != "closed" && authWebhookFailure != "open" {
+		logMain.Error("invalid_option", nil, "invalid authorization webhook failure mode specified")
+		os.Exit(6)
+	}
+	if originCheck != "always" && originCheck != "unauthenticated" {
+		logMain.Error("invalid_option", nil, "invalid origin check specified")
+		os.Exit(6)
+	}
+	allowedOrigins, err = parseAllowedOrigins(originAllowlist)
+	if err != nil {
+		logMain.Error("invalid_option", nil, "%v", err)
+		os.Exit(6)
+	}
+
+	quotaFallbackBandwidth, err = parseBandwidth(quotaFallback)
+	if err != nil {
+		logMain.Error("invalid_option", nil, "invalid quota fallback bandwidth specified: %v", err)
+		os.Exit(6)
+	}
+	if quotaAction != "throttle" && quotaAction != "disconnect" {
+		logMain.Error("invalid_option", nil, "invalid quota action specified")
+		os.Exit(6)
+	}
+	if quotaAction == "throttle" && quotaFallbackBandwidth.Unlimited() {
+		logMain.Error("invalid_option", nil, "quota fallback bandwidth is required to throttle clients")
+		os.Exit(6)
+	}
+	if quotaPeriodLength != "day" && quotaPeriodLength != "month" {
+		logMain.Error("invalid_option", nil, "invalid quota period specified")
+		os.Exit(6)
+	}
+	if quotaWarning < 1 || quotaWarning > 100 {
+		logMain.Error("invalid_option", nil, "invalid quota warning threshold specified")
+		os.Exit(6)
+	}
+	if quotaStateFile != "" {
+		if err := quotas.Load(quotaStateFile); err != nil {
+			logMain.Error("startup_failed", nil, "loading quota state: %v", err)
+			os.Exit(6)
+		}
+		go quotas.saveLoop()
+	}
+
+	if banListFile != "" {
+		if err := bans.Load(banListFile); err != nil {
+			logMain.Error("startup_failed", nil, "loading ban list: %v", err)
+			os.Exit(6)
+		}
+	}
+
 	tap, err = water.NewTAP(tapName)
 	if err != nil {
-		ErrorPrintf("creating TAP interface: %v", err)
+		logMain.Error("startup_failed", nil, "creating TAP interface: %v", err)
 		os.Exit(5)
 	}
 	if err := exec.Command("ip", "link", "set", tap.Name(), "up").Run(); err != nil {
-		ErrorPrintf("bringing TAP interface up: %v", err)
+		logMain.Error("startup_failed", nil, "bringing TAP interface up: %v", err)
 	}
 	if err := exec.Command("ip", "addr", "add", tapIPv4, "brd", "+", "dev", tap.Name()).Run(); err != nil {
-		ErrorPrintf("configuring TAP interface IPv4: %v", err)
+		logMain.Error("startup_failed", nil, "configuring TAP interface IPv4: %v", err)
 	}
-	InfoPrintf("device %s is up with IPv4 %s", tap.Name(), tapIPv4)
+	logMain.Info("tap_up", nil, "device %s is up with IPv4 %s", tap.Name(), tapIPv4)
+	go uplink.run()
 
 	if staticDirectory != "" {
 		http.Handle("/", http.FileServer(http.Dir(staticDirectory)))
 	}
-	http.Handle("/wstap", websocket.Handler(websocketHandler))
+	http.Handle("/wstap", newWstapHandler())
 
-	InfoPrintf("listening on %s", listenAddress)
+	logMain.Info("listening", nil, "listening on %s", listenAddress)
+
+	mainFlow := make(chan error, 4)
+	server := &http.Server{Addr: listenAddress}
+	if clientCAFile != "" {
+		server.TLSConfig = newTLSConfig()
+	}
 
-	mainFlow := make(chan error, 2)
+	servers := []*http.Server{server}
 
 	go func() {
+		var err error
 		if keyFile == "" {
-			mainFlow <- http.ListenAndServe(listenAddress, nil)
+			err = server.ListenAndServe()
 		} else {
-			mainFlow <- http.ListenAndServeTLS(listenAddress, certFile, keyFile, nil)
+			err = server.ListenAndServeTLS(certFile, keyFile)
+		}
+		if err != http.ErrServerClosed {
+			mainFlow <- err
 		}
 	}()
 
+	if adminAddress != "" {
+		logMain.Info("listening", nil, "administrative interface listening on %s", adminAddress)
+		admin := &http.Server{Addr: adminAddress, Handler: newAdminHandler()}
+		servers = append(servers, admin)
+		go func() {
+			if err := admin.ListenAndServe(); err != http.ErrServerClosed {
+				mainFlow <- err
+			}
+		}()
+	}
+
+	if metricsAddress != "" {
+		logMain.Info("listening", nil, "metrics endpoint listening on %s", metricsAddress)
+		metricsServer := &http.Server{Addr: metricsAddress, Handler: newMetricsHandler()}
+		servers = append(servers, metricsServer)
+		go func() {
+			if err := metricsServer.ListenAndServe(); err != http.ErrServerClosed {
+				mainFlow <- err
+			}
+		}()
+	}
+
 	go func() {
 		// start a polling goroutine that reads and switches frames from the TAP interface
 		mainFlow <- readTAPTraffic()
 	}()
 
-	err = <-mainFlow
-	if err != nil {
-		ErrorPrintf("%v", err)
-		hub.Clear()
-		os.Exit(7)
-	} else {
-		hub.Clear()
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM, syscall.SIGHUP)
+
+	for {
+		select {
+		case err = <-mainFlow:
+			hub.Clear()
+			teardownTAP()
+			if err != nil {
+				logMain.Error("fatal", nil, "%v", err)
+				os.Exit(7)
+			}
+			return
+		case sig := <-signals:
+			if sig == syscall.SIGHUP {
+				if _, err := reloadConfig(); err != nil {
+					logMain.Error("config_reload_failed", nil, "reloading configuration: %v", err)
+				}
+				continue
+			}
+			logMain.Info("shutting_down", nil, "received %v, shutting down", sig)
+			shutdown(servers)
+			return
+		}
 	}
 }